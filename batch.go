@@ -0,0 +1,293 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Volume is a set of targets reaching the same LUN, one per path.
+type Volume struct {
+	ID      string
+	Targets []*Target
+}
+
+type VolumeResult struct {
+	ID   string
+	Disk *Disk
+	Err  error
+}
+
+// AttachVolumes logs in the targets of many volumes and returns the disk of
+// each volume in the order of volumes. Compared with calling Login and GetDisk
+// per volume, targets shared by volumes are logged in once, the sessions of
+// targets already logged in are rescanned once and all volumes wait for their
+// devices under one deadline.
+func (iscsi *ISCSIUtil) AttachVolumes(ctx context.Context, volumes []*Volume) []*VolumeResult {
+	ctx, span := iscsi.startSpan(ctx, "AttachVolumes", attribute.Int("volumeCnt", len(volumes)))
+	defer endSpan(span, nil)
+
+	results := make([]*VolumeResult, len(volumes))
+	resolved := make([][]*Target, len(volumes))
+	sessions := iscsi.sessions(ctx, false)
+
+	// Collect the targets to log in, once per node record. Targets with a
+	// session still go through loginTarget to top up sessions and update the
+	// node startup, and their sessions are rescanned for new LUNs.
+	var logins, rescans []*Target
+	loginErrs := make(map[string]error)
+	for i, vol := range volumes {
+		results[i] = &VolumeResult{ID: vol.ID}
+		if err := validateTargets(vol.Targets); err != nil {
+			results[i].Err = err
+			continue
+		}
+
+		resolved[i] = iscsi.resolveTargets(ctx, sessions, vol.Targets)
+		for _, target := range resolved[i] {
+			key := targetLockKey(target)
+			if _, ok := loginErrs[key]; ok {
+				continue
+			}
+			loginErrs[key] = nil
+			logins = append(logins, target)
+			if cnt, _ := targetSessionCount(sessions, target); cnt > 0 {
+				rescans = append(rescans, target)
+			}
+		}
+	}
+	iscsi.logger().V(1).Info("Attach volumes", "volumeCnt", len(volumes), "loginCnt", len(logins), "rescanCnt", len(rescans))
+
+	errs := make([]error, len(logins))
+	forEach(ctx, len(logins), iscsi.workers(), func(ctx context.Context, i int) {
+		if errs[i] = ctx.Err(); errs[i] == nil {
+			_, errs[i] = iscsi.loginTarget(ctx, logins[i])
+		}
+	})
+	for i, target := range logins {
+		loginErrs[targetLockKey(target)] = errs[i]
+	}
+
+	if len(rescans) > 0 {
+		rescanned := make(map[int]bool)
+		for _, target := range rescans {
+			for _, sess := range sessions {
+				if !sessionOfTarget(sess, target) || rescanned[sess.SID] {
+					continue
+				}
+				rescanned[sess.SID] = true
+				if err := iscsi.rescanSessionByID(ctx, sess.SID); err != nil {
+					iscsi.logger().Error(err, "Failed to rescan session", "sid", sess.SID)
+				}
+			}
+		}
+		iscsi.InvalidateSessionCache()
+	}
+
+	// A volume fails only if the login of all its targets failed
+	var pending []int
+	for i, targets := range resolved {
+		if results[i].Err != nil {
+			continue
+		}
+
+		var err error
+		success := false
+		for _, target := range targets {
+			if err = loginErrs[targetLockKey(target)]; err == nil {
+				success = true
+			}
+		}
+		if !success {
+			results[i].Err = fmt.Errorf("Login failed, err: %v", err)
+			continue
+		}
+		pending = append(pending, i)
+	}
+
+	iscsi.waitVolumeDisks(ctx, resolved, pending, results)
+	return results
+}
+
+// waitVolumeDisks polls one session snapshot per round for the devices of the
+// pending volumes until all of them are ready or the shared deadline expires.
+func (iscsi *ISCSIUtil) waitVolumeDisks(ctx context.Context, resolved [][]*Target, pending []int, results []*VolumeResult) {
+	ctx, cancel := context.WithTimeout(ctx, (deviceRetryCnt*deviceRetryTimeout+dmRetryCnt*dmRetryTimeout)*time.Millisecond)
+	defer cancel()
+
+	devMaps := make([]map[string]*Device, len(resolved))
+	for retries := 1; len(pending) > 0; retries++ {
+		retryCtx, retrySpan := iscsi.startSpan(ctx, "AttachVolumes.retry",
+			attribute.Int("retry", retries), attribute.Int("pendingCnt", len(pending)))
+		sessions := iscsi.sessions(retryCtx, true)
+		var waiting []int
+		for _, i := range pending {
+			devMap := make(map[string]*Device)
+			targetPending := false
+			for _, target := range resolved[i] {
+				m, p := iscsi.collectTargetDevices(retryCtx, sessions, target)
+				for kname, dev := range m {
+					devMap[kname] = dev
+				}
+				targetPending = targetPending || p
+			}
+			devMaps[i] = devMap
+
+			if targetPending || !iscsi.diskReady(devMap, len(resolved[i])*iscsi.nrSessions()) {
+				waiting = append(waiting, i)
+			}
+		}
+
+		pending = waiting
+		retrySpan.End()
+		if len(pending) == 0 {
+			break
+		}
+		iscsi.logger().V(3).Info("Volumes not ready, try again", "pendingCnt", len(pending), "delay", time.Millisecond*dmRetryTimeout)
+		if err := sleepContext(ctx, time.Millisecond*dmRetryTimeout); err != nil {
+			iscsi.logger().Info("Stop waiting volumes", "pendingCnt", len(pending), "err", err)
+			break
+		}
+	}
+
+	for i, targets := range resolved {
+		if results[i].Err == nil && devMaps[i] != nil {
+			results[i].Disk = iscsi.newDisk(devMaps[i], len(targets)*iscsi.nrSessions())
+		}
+	}
+}
+
+// DetachVolumes removes the disk of each volume and logs out the targets
+// which have no LUN left afterwards. The multipath device is flushed and the
+// SCSI devices are deleted. Volumes with a mounted disk are not detached.
+func (iscsi *ISCSIUtil) DetachVolumes(ctx context.Context, volumes []*Volume) []*VolumeResult {
+	ctx, span := iscsi.startSpan(ctx, "DetachVolumes", attribute.Int("volumeCnt", len(volumes)))
+	defer endSpan(span, nil)
+
+	results := make([]*VolumeResult, len(volumes))
+	sessions := iscsi.sessions(ctx, false)
+
+	var logouts []*Target
+	users := make(map[string][]int)
+	for i, vol := range volumes {
+		results[i] = &VolumeResult{ID: vol.ID}
+		if err := validateTargets(vol.Targets); err != nil {
+			results[i].Err = err
+			continue
+		}
+
+		targets := iscsi.resolveTargets(ctx, sessions, vol.Targets)
+		if results[i].Err = iscsi.detachVolume(ctx, sessions, targets, results[i]); results[i].Err != nil {
+			continue
+		}
+
+		for _, target := range targets {
+			key := targetLockKey(target)
+			if _, ok := users[key]; !ok {
+				logouts = append(logouts, target)
+			}
+			if n := len(users[key]); n == 0 || users[key][n-1] != i {
+				users[key] = append(users[key], i)
+			}
+		}
+	}
+
+	// Targets shared with volumes that are still attached keep their sessions
+	sessions = iscsi.sessions(ctx, true)
+	var unused []*Target
+	for _, target := range logouts {
+		inUse := false
+		for _, sess := range sessions {
+			if sess.Portal == canonicalPortal(target.Portal) && sess.Target == target.Name &&
+				sessionIfaceMatches(sess, target.Iface) && len(sess.SCSIDevices) > 0 {
+				inUse = true
+			}
+		}
+		if !inUse {
+			unused = append(unused, target)
+		}
+	}
+	iscsi.logger().V(1).Info("Detach volumes", "volumeCnt", len(volumes), "logoutCnt", len(unused))
+
+	errs := make([]error, len(unused))
+	forEach(ctx, len(unused), iscsi.workers(), func(ctx context.Context, i int) {
+		if errs[i] = ctx.Err(); errs[i] == nil {
+			errs[i] = iscsi.logoutTarget(ctx, unused[i])
+		}
+	})
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		iscsi.logger().Error(err, "Failed to logout", targetValues(unused[i])...)
+		for _, j := range users[targetLockKey(unused[i])] {
+			if results[j].Err == nil {
+				results[j].Err = err
+			}
+		}
+	}
+
+	return results
+}
+
+// detachVolume removes the disk of a volume while its targets are locked, so
+// that a concurrent login of the same targets cannot add devices meanwhile.
+func (iscsi *ISCSIUtil) detachVolume(ctx context.Context, sessions []*Session, targets []*Target, result *VolumeResult) error {
+	unlock, err := iscsi.lockTargets(targets)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	devMap := make(map[string]*Device)
+	for _, target := range targets {
+		m, _ := iscsi.collectTargetDevices(ctx, sessions, target)
+		for kname, dev := range m {
+			devMap[kname] = dev
+		}
+	}
+
+	result.Disk = iscsi.newDisk(devMap, len(targets)*iscsi.nrSessions())
+	return iscsi.removeVolumeDisk(ctx, result.Disk)
+}
+
+// removeVolumeDisk flushes the multipath device of disk and deletes its SCSI
+// devices. Nothing is removed if any of the devices or their holders is mounted.
+func (iscsi *ISCSIUtil) removeVolumeDisk(ctx context.Context, disk *Disk) error {
+	knames := make([]string, 0, len(disk.Devices)+1)
+	for kname := range disk.Devices {
+		knames = append(knames, kname)
+	}
+	if _, ok := disk.Devices[disk.Name]; !ok && disk.Name != "" {
+		knames = append(knames, disk.Name)
+	}
+	sort.Strings(knames)
+	for _, kname := range knames {
+		if mnts := iscsi.getMountPoints(ctx, "/dev/"+kname); len(mnts) > 0 {
+			return fmt.Errorf("Disk %s is mounted on %v", kname, mnts)
+		}
+	}
+
+	for _, dev := range disk.Devices {
+		if dev.Type == "mpath" {
+			if _, err := iscsi.execCmd(ctx, "multipath", "-f", dev.Name); err != nil {
+				return fmt.Errorf("Failed to flush multipath device %s, err: %v", dev.Name, err)
+			}
+		}
+	}
+
+	for kname, dev := range disk.Devices {
+		if dev.Type == "disk" {
+			if err := iscsi.RemoveDisk("/dev/" + kname); err != nil {
+				return fmt.Errorf("Failed to remove disk %s, err: %v", kname, err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type SessionCacheStats struct {
+	Hits          uint64
+	Misses        uint64
+	Invalidations uint64
+}
+
+// sessionCache keeps the last session snapshot for ISCSIOptions.SessionCacheTTL.
+type sessionCache struct {
+	mu       sync.Mutex
+	sessions []*Session
+	expires  time.Time
+	gen      uint64 // Incremented by invalidation
+	stats    SessionCacheStats
+}
+
+// sessions returns the session snapshot, from the cache if it is enabled and
+// not expired unless fresh is set. A fresh snapshot also refreshes the cache.
+func (iscsi *ISCSIUtil) sessions(ctx context.Context, fresh bool) []*Session {
+	ttl := iscsi.Opts.SessionCacheTTL
+	if ttl <= 0 {
+		return iscsi.getSessions(ctx)
+	}
+
+	c := &iscsi.cache
+	c.mu.Lock()
+	if !fresh && c.sessions != nil && time.Now().Before(c.expires) {
+		c.stats.Hits++
+		sessions := c.sessions
+		c.mu.Unlock()
+		return sessions
+	}
+	c.stats.Misses++
+	gen := c.gen
+	c.mu.Unlock()
+
+	return iscsi.cacheSessions(gen, iscsi.getSessions(ctx))
+}
+
+// freshSessions takes a new session snapshot like sessions(ctx, true), but
+// returns the error of a failed iscsiadm run instead of an empty snapshot,
+// for callers that act on missing sessions. A failed snapshot is not cached.
+func (iscsi *ISCSIUtil) freshSessions(ctx context.Context) ([]*Session, error) {
+	if iscsi.Opts.SessionCacheTTL <= 0 {
+		return iscsi.listSessions(ctx)
+	}
+
+	c := &iscsi.cache
+	c.mu.Lock()
+	c.stats.Misses++
+	gen := c.gen
+	c.mu.Unlock()
+
+	sessions, err := iscsi.listSessions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return iscsi.cacheSessions(gen, sessions), nil
+}
+
+// cacheSessions stores sessions taken at cache generation gen.
+func (iscsi *ISCSIUtil) cacheSessions(gen uint64, sessions []*Session) []*Session {
+	if sessions == nil {
+		sessions = []*Session{}
+	}
+
+	// Do not cache a snapshot that may predate an invalidation
+	c := &iscsi.cache
+	c.mu.Lock()
+	if gen == c.gen {
+		c.sessions = sessions
+		c.expires = time.Now().Add(iscsi.Opts.SessionCacheTTL)
+	}
+	c.mu.Unlock()
+
+	return sessions
+}
+
+// lockedSessions returns the session snapshot for use under a target lock.
+// Sessions changed by other processes are not visible in the cache, so the
+// snapshot is fresh when locks are shared with other processes.
+func (iscsi *ISCSIUtil) lockedSessions(ctx context.Context) []*Session {
+	return iscsi.sessions(ctx, iscsi.Opts.LockDir != "")
+}
+
+// InvalidateSessionCache drops the cached session snapshot. It is called after
+// operations that change sessions or devices.
+func (iscsi *ISCSIUtil) InvalidateSessionCache() {
+	c := &iscsi.cache
+	c.mu.Lock()
+	c.gen++
+	if c.sessions != nil {
+		c.sessions = nil
+		c.stats.Invalidations++
+	}
+	c.mu.Unlock()
+}
+
+func (iscsi *ISCSIUtil) SessionCacheStats() SessionCacheStats {
+	c := &iscsi.cache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
@@ -0,0 +1,49 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSessionCache(t *testing.T) {
+	util := &ISCSIUtil{Opts: ISCSIOptions{SessionCacheTTL: time.Minute}}
+
+	util.sessions(context.Background(), false)
+	util.sessions(context.Background(), false)
+	util.GetSession()
+	if stats := util.SessionCacheStats(); stats.Misses != 1 || stats.Hits != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	util.sessions(context.Background(), true)
+	if stats := util.SessionCacheStats(); stats.Misses != 2 || stats.Hits != 2 {
+		t.Fatalf("fresh snapshot should miss: %+v", stats)
+	}
+
+	util.InvalidateSessionCache()
+	util.sessions(context.Background(), false)
+	if stats := util.SessionCacheStats(); stats.Misses != 3 || stats.Invalidations != 1 {
+		t.Fatalf("invalidated cache should miss: %+v", stats)
+	}
+
+	util.Opts.SessionCacheTTL = time.Nanosecond
+	util.InvalidateSessionCache()
+	util.sessions(context.Background(), false)
+	time.Sleep(time.Millisecond)
+	util.sessions(context.Background(), false)
+	if stats := util.SessionCacheStats(); stats.Misses != 5 {
+		t.Fatalf("expired cache should miss: %+v", stats)
+	}
+}
+
+func TestSessionCacheDisabled(t *testing.T) {
+	util := &ISCSIUtil{}
+	util.sessions(context.Background(), false)
+	util.sessions(context.Background(), false)
+	if stats := util.SessionCacheStats(); stats != (SessionCacheStats{}) {
+		t.Fatalf("disabled cache should have no stats: %+v", stats)
+	}
+}
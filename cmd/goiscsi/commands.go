@@ -0,0 +1,410 @@
+// @2022 QSAN Inc. All right reserved
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/QsanJohnson/goiscsi"
+)
+
+// chapPasswdEnv is the environment variable of the CHAP password.
+const chapPasswdEnv = "GOISCSI_CHAP_PASSWD"
+
+// targetResult is a row of the login and logout results.
+type targetResult struct {
+	Volume   string        `json:"volume"`
+	Target   string        `json:"target"`
+	Portal   string        `json:"portal"`
+	Lun      uint64        `json:"lun"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// volumeDisk is a row of the disk, detach and check results.
+type volumeDisk struct {
+	Volume string        `json:"volume"`
+	Disk   *goiscsi.Disk `json:"disk,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+func runDiscover(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("discover", flag.ExitOnError)
+	portal := fs.String("portal", "", "Portal to discover")
+	chapUser := fs.String("chap-user", "", "Discovery CHAP user name, the password is read from "+chapPasswdEnv)
+	chapStdin := fs.Bool("chap-passwd-stdin", false, "Read the discovery CHAP password from the first line of stdin")
+	fs.Parse(args)
+	if *portal == "" {
+		return fmt.Errorf("-portal is required")
+	}
+
+	var chap *goiscsi.Chap
+	if *chapUser != "" {
+		passwd, err := readChapPasswd(a.in, *chapStdin)
+		if err != nil {
+			return err
+		}
+		chap = &goiscsi.Chap{User: *chapUser, Passwd: passwd}
+	}
+	targets, err := a.iscsi.Discover(ctx, *portal, chap)
+	if err != nil {
+		return err
+	}
+
+	var rows []*targetResult
+	for _, target := range targets {
+		rows = append(rows, &targetResult{Target: target.Name, Portal: target.Portal})
+	}
+	return a.print(rows, []string{"PORTAL", "TARGET"}, func(row func(...interface{})) {
+		for _, r := range rows {
+			row(r.Portal, r.Target)
+		}
+	})
+}
+
+// readChapPasswd returns the CHAP password from the first line of stdin if
+// fromStdin is set, or else from the GOISCSI_CHAP_PASSWD environment variable,
+// so that it does not show in the process list.
+func readChapPasswd(stdin io.Reader, fromStdin bool) (string, error) {
+	if fromStdin {
+		line, err := bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", fmt.Errorf("Failed to read CHAP password from stdin, err: %v", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	if passwd := os.Getenv(chapPasswdEnv); passwd != "" {
+		return passwd, nil
+	}
+	return "", fmt.Errorf("CHAP password is required, set %s or -chap-passwd-stdin", chapPasswdEnv)
+}
+
+func runLogin(ctx context.Context, a *app, args []string) error {
+	volumes, err := parseTargetArgs("login", a, args)
+	if err != nil {
+		return err
+	}
+
+	var rows []*targetResult
+	var loginErr error
+	for _, vol := range volumes {
+		results, err := a.iscsi.LoginContext(ctx, vol.Targets)
+		if err != nil {
+			loginErr = fmt.Errorf("Volume %s: %v", vol.ID, err)
+		}
+		for _, result := range results {
+			rows = append(rows, newTargetResult(vol.ID, result.Target, result.Err, result.Duration))
+		}
+		if results == nil && err != nil {
+			rows = append(rows, &targetResult{Volume: vol.ID, Error: err.Error()})
+		}
+	}
+
+	if err := a.printTargetResults(rows); err != nil {
+		return err
+	}
+	return loginErr
+}
+
+func runLogout(ctx context.Context, a *app, args []string) error {
+	volumes, err := parseTargetArgs("logout", a, args)
+	if err != nil {
+		return err
+	}
+
+	var rows []*targetResult
+	var logoutErr error
+	for _, vol := range volumes {
+		start := time.Now()
+		err := a.iscsi.LogoutContext(ctx, vol.Targets)
+		if err != nil {
+			logoutErr = fmt.Errorf("Volume %s: %v", vol.ID, err)
+		}
+		for _, target := range vol.Targets {
+			rows = append(rows, newTargetResult(vol.ID, target, err, time.Since(start)))
+		}
+	}
+
+	if err := a.printTargetResults(rows); err != nil {
+		return err
+	}
+	return logoutErr
+}
+
+func runSessions(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("sessions", flag.ExitOnError)
+	fs.Parse(args)
+
+	sessions := a.iscsi.GetSession()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].SID < sessions[j].SID })
+	return a.print(sessions, []string{"SID", "TARGET", "PORTAL", "IFACE", "STATE", "DEVICES"}, func(row func(...interface{})) {
+		for _, sess := range sessions {
+			var devs []string
+			for _, scsiDev := range sess.SCSIDevices {
+				devs = append(devs, fmt.Sprintf("%d:%s:%s", scsiDev.Lun, scsiDev.Name, scsiDev.State))
+			}
+			row(sess.SID, sess.Target, sess.Portal, sess.Iface, sess.State, strings.Join(devs, ","))
+		}
+	})
+}
+
+func runDisk(ctx context.Context, a *app, args []string) error {
+	volumes, err := parseTargetArgs("disk", a, args)
+	if err != nil {
+		return err
+	}
+
+	var rows []*volumeDisk
+	for _, vol := range volumes {
+		disk, err := a.iscsi.GetDiskContext(ctx, vol.Targets)
+		rows = append(rows, newVolumeDisk(vol.ID, disk, err))
+	}
+
+	if a.json {
+		return a.printJSON(rows)
+	}
+	if err := a.printDisks(rows); err != nil {
+		return err
+	}
+	fmt.Fprintln(a.out)
+	return a.printTable([]string{"VOLUME", "DEVICE", "TYPE", "STATE", "SIZE", "VENDOR", "MODEL", "SERIAL"}, func(row func(...interface{})) {
+		for _, r := range rows {
+			if r.Disk == nil {
+				continue
+			}
+			var names []string
+			for name := range r.Disk.Devices {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				dev := r.Disk.Devices[name]
+				row(r.Volume, dev.Name, dev.Type, dev.State, dev.Size, dev.Vendor, dev.Model, dev.Serial)
+			}
+		}
+	})
+}
+
+func runRescan(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("rescan", flag.ExitOnError)
+	f := addTargetFlags(fs)
+	fs.Parse(args)
+
+	if !f.set() && a.profile == nil {
+		return a.iscsi.RescanSessionByTargetContext(ctx, nil)
+	}
+	volumes, err := f.volumes(a.profile)
+	if err != nil {
+		return err
+	}
+	for _, vol := range volumes {
+		if err := a.iscsi.RescanSessionByTargetContext(ctx, vol.Targets); err != nil {
+			return fmt.Errorf("Volume %s: %v", vol.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func runRemove(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("remove", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return fmt.Errorf("No device to remove")
+	}
+
+	for _, devPath := range fs.Args() {
+		if err := a.iscsi.RemoveDisk(devPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func runDetach(ctx context.Context, a *app, args []string) error {
+	volumes, err := parseTargetArgs("detach", a, args)
+	if err != nil {
+		return err
+	}
+
+	var rows []*volumeDisk
+	var detachErr error
+	for _, result := range a.iscsi.DetachVolumes(ctx, volumes) {
+		if result.Err != nil {
+			detachErr = fmt.Errorf("Volume %s: %v", result.ID, result.Err)
+		}
+		rows = append(rows, newVolumeDisk(result.ID, result.Disk, result.Err))
+	}
+
+	if err := a.printDisks(rows); err != nil {
+		return err
+	}
+	return detachErr
+}
+
+func runCheck(ctx context.Context, a *app, args []string) error {
+	volumes, err := parseTargetArgs("check", a, args)
+	if err != nil {
+		return err
+	}
+
+	var rows []*volumeDisk
+	var unhealthy []string
+	for _, vol := range volumes {
+		disk, err := a.iscsi.GetDiskContext(ctx, vol.Targets)
+		if err == nil && disk.Status != "online" {
+			err = fmt.Errorf("Disk is %s", disk.Status)
+		}
+		if err != nil {
+			unhealthy = append(unhealthy, vol.ID)
+		}
+		rows = append(rows, newVolumeDisk(vol.ID, disk, err))
+	}
+
+	if err := a.printDisks(rows); err != nil {
+		return err
+	}
+	if len(unhealthy) > 0 {
+		return fmt.Errorf("Volume %s not online", strings.Join(unhealthy, ","))
+	}
+	return nil
+}
+
+func runTopology(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("topology", flag.ExitOnError)
+	fs.Parse(args)
+
+	topo, err := a.iscsi.Topology(ctx)
+	if err != nil {
+		return err
+	}
+	if a.json {
+		return a.printJSON(topo)
+	}
+	return topo.WriteDOT(a.out)
+}
+
+func runDiag(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("diag", flag.ExitOnError)
+	output := fs.String("o", "", "Output file, default is goiscsi-diag-<host>-<time>.tar.gz, - for stdout")
+	fs.Parse(args)
+
+	if *output == "-" {
+		return a.iscsi.CollectDiagnostics(ctx, os.Stdout)
+	}
+	if *output == "" {
+		host, _ := os.Hostname()
+		*output = fmt.Sprintf("goiscsi-diag-%s-%s.tar.gz", host, time.Now().Format("20060102-150405"))
+	}
+
+	file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := a.iscsi.CollectDiagnostics(ctx, file); err != nil {
+		file.Close()
+		os.Remove(*output)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Diagnostics written to %s\n", *output)
+	return nil
+}
+
+// parseTargetArgs parses the target flags of command and returns its volumes.
+func parseTargetArgs(command string, a *app, args []string) ([]*goiscsi.Volume, error) {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	f := addTargetFlags(fs)
+	fs.Parse(args)
+	if err := f.readChap(a.in); err != nil {
+		return nil, err
+	}
+	return f.volumes(a.profile)
+}
+
+func newTargetResult(volume string, target *goiscsi.Target, err error, d time.Duration) *targetResult {
+	r := &targetResult{Volume: volume, Target: target.Name, Portal: target.Portal, Lun: target.Lun, Duration: d}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+func newVolumeDisk(volume string, disk *goiscsi.Disk, err error) *volumeDisk {
+	r := &volumeDisk{Volume: volume, Disk: disk}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+func (a *app) printTargetResults(rows []*targetResult) error {
+	return a.print(rows, []string{"VOLUME", "TARGET", "PORTAL", "LUN", "RESULT", "DURATION"}, func(row func(...interface{})) {
+		for _, r := range rows {
+			row(r.Volume, r.Target, r.Portal, r.Lun, result(r.Error), r.Duration.Round(time.Millisecond))
+		}
+	})
+}
+
+func (a *app) printDisks(rows []*volumeDisk) error {
+	return a.print(rows, []string{"VOLUME", "NAME", "STATUS", "VALID", "SIZE", "MPATH", "DISKS", "RESULT"}, func(row func(...interface{})) {
+		for _, r := range rows {
+			if r.Disk == nil {
+				row(r.Volume, "", "", "", "", "", "", result(r.Error))
+				continue
+			}
+			d := r.Disk
+			row(r.Volume, d.Name, d.Status, d.Valid, d.Size, d.MpathCnt, d.DiskCnt, result(r.Error))
+		}
+	})
+}
+
+// print prints v as JSON with -json, or else a table of headers with the rows
+// added by rows.
+func (a *app) print(v interface{}, headers []string, rows func(row func(...interface{}))) error {
+	if a.json {
+		return a.printJSON(v)
+	}
+	return a.printTable(headers, rows)
+}
+
+func (a *app) printJSON(v interface{}) error {
+	enc := json.NewEncoder(a.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (a *app) printTable(headers []string, rows func(row func(...interface{}))) error {
+	tw := tabwriter.NewWriter(a.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(headers, "\t"))
+	rows(func(values ...interface{}) {
+		cells := make([]string, len(values))
+		for i, value := range values {
+			cells[i] = fmt.Sprint(value)
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	})
+	return tw.Flush()
+}
+
+func result(err string) string {
+	if err == "" {
+		return "ok"
+	}
+	return strings.TrimSpace(err)
+}
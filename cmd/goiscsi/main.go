@@ -0,0 +1,113 @@
+// @2022 QSAN Inc. All right reserved
+
+// Command goiscsi manages iSCSI disks with the goiscsi package.
+//
+// Targets are given by the -portal, -target and -lun flags of a command or by
+// the volumes of the profile file set by -profile, see goiscsi.LoadProfile.
+// Output is a table, or JSON with -json.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/QsanJohnson/goiscsi"
+	"k8s.io/klog/v2"
+)
+
+// app is the state shared by commands.
+type app struct {
+	iscsi   *goiscsi.ISCSIUtil
+	profile *goiscsi.Profile // nil if -profile is not set
+	json    bool
+	in      io.Reader
+	out     io.Writer
+}
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, a *app, args []string) error
+}
+
+var commands = map[string]*command{
+	"discover": {"discover -portal addr [-chap-user user [-chap-passwd-stdin]]\n\tList the targets of a portal", runDiscover},
+	"login":    {"login <targets>\n\tLog in targets", runLogin},
+	"logout":   {"logout <targets>\n\tLog out targets", runLogout},
+	"sessions": {"sessions\n\tList sessions and their SCSI devices", runSessions},
+	"disk":     {"disk <targets>\n\tShow the disk and devices of volumes", runDisk},
+	"rescan":   {"rescan [<targets>]\n\tRescan the sessions of targets, or all sessions", runRescan},
+	"remove":   {"remove /dev/sdX...\n\tDelete SCSI devices", runRemove},
+	"detach":   {"detach <targets>\n\tFlush and delete the disk of volumes and log out unused targets", runDetach},
+	"check":    {"check <targets>\n\tExit with an error unless the disk of every volume is online", runCheck},
+	"topology": {"topology\n\tPrint the storage graph of sessions as Graphviz DOT, or JSON with -json", runTopology},
+	"diag":     {"diag [-o file]\n\tWrite a diagnostics bundle (tar.gz) for support cases", runDiag},
+}
+
+func main() {
+	klog.InitFlags(nil)
+	profileFile := flag.String("profile", "", "Profile file of volumes, INI (test.conf), YAML or JSON")
+	flag.StringVar(profileFile, "config", "", "Alias of -profile")
+	jsonOutput := flag.Bool("json", false, "Print JSON instead of tables")
+	timeout := flag.Int("timeout", 0, "Timeout of login and logout in milliseconds, unlimited if zero")
+	iface := flag.String("iface", "", "Default iface name or hardware address of targets")
+	nrSessions := flag.Int("nr-sessions", 1, "Number of sessions per target")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	a := &app{json: *jsonOutput, in: os.Stdin, out: os.Stdout}
+	a.iscsi = &goiscsi.ISCSIUtil{Opts: goiscsi.ISCSIOptions{
+		Timeout:    time.Duration(*timeout),
+		Iface:      *iface,
+		NrSessions: *nrSessions,
+	}}
+	if *profileFile != "" {
+		profile, err := goiscsi.LoadProfile(*profileFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		a.profile = profile
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := cmd.run(ctx, a, flag.Args()[1:])
+	klog.Flush()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: goiscsi [-profile file] [-json] [-timeout ms] [-iface name] [-nr-sessions n] [-v level] <command> [flags]\n\nCommands:\n")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\n<targets> are -portal, -target, -lun, -iface and -chap-user/-chap-passwd-stdin flags,\n"+
+		"or -volume to select a volume of the profile, all volumes by default.\n")
+}
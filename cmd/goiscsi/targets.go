@@ -0,0 +1,120 @@
+// @2022 QSAN Inc. All right reserved
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/QsanJohnson/goiscsi"
+)
+
+const cliVolumeID = "cli"
+
+// targetFlags are the flags selecting the volumes of a command.
+type targetFlags struct {
+	portals, names, luns string
+	iface                string
+	chapUser, chapPasswd string
+	chapStdin            bool
+	volume               string
+}
+
+func addTargetFlags(fs *flag.FlagSet) *targetFlags {
+	f := &targetFlags{}
+	fs.StringVar(&f.portals, "portal", "", "Comma separated portals, one target per portal")
+	fs.StringVar(&f.names, "target", "", "Comma separated target names, one for all portals or one per portal")
+	fs.StringVar(&f.luns, "lun", "0", "Comma separated LUNs, one for all portals or one per portal")
+	fs.StringVar(&f.iface, "iface", "", "Iface name or hardware address of the targets")
+	fs.StringVar(&f.chapUser, "chap-user", "", "CHAP user name, the password is read from "+chapPasswdEnv)
+	fs.BoolVar(&f.chapStdin, "chap-passwd-stdin", false, "Read the CHAP password from the first line of stdin")
+	fs.StringVar(&f.volume, "volume", "", "Volume ID of the profile, all volumes if empty")
+	return f
+}
+
+// readChap reads the CHAP password if -chap-user is set.
+func (f *targetFlags) readChap(stdin io.Reader) error {
+	if f.chapUser == "" {
+		return nil
+	}
+
+	var err error
+	f.chapPasswd, err = readChapPasswd(stdin, f.chapStdin)
+	return err
+}
+
+// set reports whether targets or a volume are given by flags.
+func (f *targetFlags) set() bool {
+	return f.portals != "" || f.volume != ""
+}
+
+// volumes returns the volume given by the target flags, or else the volumes
+// of profile, all of them unless -volume is set. profile may be nil.
+func (f *targetFlags) volumes(profile *goiscsi.Profile) ([]*goiscsi.Volume, error) {
+	if f.portals != "" {
+		return f.flagVolumes()
+	}
+	if profile == nil {
+		return nil, fmt.Errorf("No target, set -portal and -target or -profile")
+	}
+
+	if f.volume != "" {
+		vol := profile.Volume(f.volume)
+		if vol == nil {
+			return nil, fmt.Errorf("Volume %s not found in profile", f.volume)
+		}
+		return []*goiscsi.Volume{vol}, nil
+	}
+	return profile.Volumes, nil
+}
+
+func (f *targetFlags) flagVolumes() ([]*goiscsi.Volume, error) {
+	portals := splitList(f.portals)
+	names := splitList(f.names)
+	luns := splitList(f.luns)
+	if len(names) != 1 && len(names) != len(portals) {
+		return nil, fmt.Errorf("Expect one target name or one per portal, got %d for %d portals", len(names), len(portals))
+	}
+	if len(luns) != 1 && len(luns) != len(portals) {
+		return nil, fmt.Errorf("Expect one LUN or one per portal, got %d for %d portals", len(luns), len(portals))
+	}
+
+	id := f.volume
+	if id == "" {
+		id = cliVolumeID
+	}
+	volume := &goiscsi.Volume{ID: id}
+	for i, portal := range portals {
+		target := &goiscsi.Target{Portal: portal, Name: names[0], Iface: f.iface}
+		if len(names) > 1 {
+			target.Name = names[i]
+		}
+		lun := luns[0]
+		if len(luns) > 1 {
+			lun = luns[i]
+		}
+		var err error
+		if target.Lun, err = strconv.ParseUint(lun, 10, 64); err != nil {
+			return nil, fmt.Errorf("Invalid LUN %s", lun)
+		}
+		if f.chapUser != "" {
+			target.Chap = &goiscsi.Chap{User: f.chapUser, Passwd: f.chapPasswd}
+		}
+		volume.Targets = append(volume.Targets, target)
+	}
+
+	return []*goiscsi.Volume{volume}, nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
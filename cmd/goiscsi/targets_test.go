@@ -0,0 +1,97 @@
+// @2022 QSAN Inc. All right reserved
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/QsanJohnson/goiscsi"
+)
+
+func TestFlagVolumes(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	f := addTargetFlags(fs)
+	err := fs.Parse([]string{"-portal", "192.168.206.50,[fe80::1]:3260", "-target", "iqn.2004-08.com.qsan:dev3.ctr1,iqn.2004-08.com.qsan:dev3.ctr2",
+		"-lun", "3", "-chap-user", "johnson", "-chap-passwd-stdin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.readChap(strings.NewReader("111122223333\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	volumes, err := f.volumes(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volumes) != 1 || volumes[0].ID != cliVolumeID || len(volumes[0].Targets) != 2 {
+		t.Fatalf("volumes got %+v", volumes)
+	}
+	target := volumes[0].Targets[1]
+	if target.Portal != "[fe80::1]:3260" || target.Name != "iqn.2004-08.com.qsan:dev3.ctr2" || target.Lun != 3 || target.Chap == nil || target.Chap.User != "johnson" || target.Chap.Passwd != "111122223333" {
+		t.Errorf("target got %+v", target)
+	}
+
+	f.luns = "1,2,3"
+	if _, err := f.volumes(nil); err == nil {
+		t.Errorf("Expect error of LUN count")
+	}
+}
+
+func TestProfileVolumes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "volumes.conf")
+	data := "[vol1]\nPORTALS = 192.168.206.50\nNODES = iqn.2004-08.com.qsan:dev3.ctr1\nLUNS = 1\n" +
+		"[vol2]\nPORTALS = 192.168.206.51\nNODES = iqn.2004-08.com.qsan:dev3.ctr2\nLUNS = 2\nCHAP_USER = johnson\nCHAP_PASSWD = 111122223333\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	profile, err := goiscsi.LoadProfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &targetFlags{}
+	if volumes, err := f.volumes(profile); err != nil || len(volumes) != 2 {
+		t.Errorf("volumes got %v, err: %v", volumes, err)
+	}
+
+	f.volume = "vol2"
+	volumes, err := f.volumes(profile)
+	if err != nil || len(volumes) != 1 || volumes[0].Targets[0].Chap == nil || volumes[0].Targets[0].Lun != 2 {
+		t.Errorf("volumes got %v, err: %v", volumes, err)
+	}
+
+	f.volume = "vol3"
+	if _, err := f.volumes(profile); err == nil {
+		t.Errorf("Expect error of unknown volume")
+	}
+	if _, err := (&targetFlags{}).volumes(nil); err == nil {
+		t.Errorf("Expect error without target")
+	}
+}
+
+func TestReadChapPasswd(t *testing.T) {
+	t.Setenv(chapPasswdEnv, "")
+	if _, err := readChapPasswd(strings.NewReader(""), false); err == nil {
+		t.Errorf("Expect error without password")
+	}
+	if _, err := readChapPasswd(strings.NewReader(""), true); err == nil {
+		t.Errorf("Expect error of empty stdin")
+	}
+
+	t.Setenv(chapPasswdEnv, "111122223333")
+	if passwd, err := readChapPasswd(strings.NewReader("ignored\n"), false); err != nil || passwd != "111122223333" {
+		t.Errorf("readChapPasswd from env got %q, err: %v", passwd, err)
+	}
+	if passwd, err := readChapPasswd(strings.NewReader("444455556666\r\nnext\n"), true); err != nil || passwd != "444455556666" {
+		t.Errorf("readChapPasswd from stdin got %q, err: %v", passwd, err)
+	}
+	if passwd, err := readChapPasswd(strings.NewReader("444455556666"), true); err != nil || passwd != "444455556666" {
+		t.Errorf("readChapPasswd from stdin without newline got %q, err: %v", passwd, err)
+	}
+}
@@ -0,0 +1,231 @@
+// @2022 QSAN Inc. All right reserved
+
+// Package diag classifies iSCSI, SCSI and multipath messages of the kernel log
+// and the iscsid and multipathd journal into structured events.
+package diag
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Kind string
+
+const (
+	ConnError        Kind = "ConnError"        // Connection error, Code holds the iSCSI error code, e.g. 1020
+	PingTimeout      Kind = "PingTimeout"      // NOP-Out ping timed out
+	RecoveryTimeout  Kind = "RecoveryTimeout"  // Session recovery timed out, I/O is failed
+	SessionRecovered Kind = "SessionRecovered" // Connection is operational after recovery
+	LoginFailed      Kind = "LoginFailed"      // Login rejected or authentication failed
+	DeviceAttached   Kind = "DeviceAttached"   // SCSI disk attached
+	DeviceOffline    Kind = "DeviceOffline"    // I/O rejected by an offline SCSI device
+	IOError          Kind = "IOError"          // Block I/O error
+	PathFailed       Kind = "PathFailed"       // Multipath path failed
+	PathReinstated   Kind = "PathReinstated"   // Multipath path reinstated
+)
+
+// Event is a classified log message. Fields not found in the message are
+// zero, except SID, Host and Lun which are -1.
+type Event struct {
+	Kind    Kind          `json:"kind" yaml:"kind"`
+	Time    time.Time     `json:"time" yaml:"time"`                         // Wall clock time of journal lines
+	Uptime  time.Duration `json:"uptime,omitempty" yaml:"uptime,omitempty"` // Time since boot of kernel log lines
+	Source  string        `json:"source" yaml:"source"`                     // kernel, iscsid or multipathd
+	SID     int           `json:"sid" yaml:"sid"`                           // iSCSI session ID
+	Conn    int           `json:"conn,omitempty" yaml:"conn,omitempty"`     // iSCSI connection ID
+	Code    int           `json:"code,omitempty" yaml:"code,omitempty"`     // iSCSI error code of ConnError
+	Host    int           `json:"host" yaml:"host"`                         // SCSI host number
+	Lun     int           `json:"lun" yaml:"lun"`
+	Device  string        `json:"device,omitempty" yaml:"device,omitempty"` // Kernel name (sdb) or major:minor (8:16) of the device
+	Map     string        `json:"map,omitempty" yaml:"map,omitempty"`       // Multipath map of path events
+	Message string        `json:"message" yaml:"message"`
+}
+
+type rule struct {
+	kind   Kind
+	re     *regexp.Regexp
+	fields []string // Event fields set from the submatches of re
+}
+
+var rules = []rule{
+	{ConnError, regexp.MustCompile(`connection(\d+):(\d+): detected conn error \((\d+)\)`), []string{"sid", "conn", "code"}},
+	{ConnError, regexp.MustCompile(`Kernel reported iSCSI connection (\d+):(\d+) error \((\d+)`), []string{"sid", "conn", "code"}},
+	{PingTimeout, regexp.MustCompile(`connection(\d+):(\d+): ping timeout`), []string{"sid", "conn"}},
+	{RecoveryTimeout, regexp.MustCompile(`session(\d+): session recovery timed out`), []string{"sid"}},
+	{SessionRecovered, regexp.MustCompile(`connection(\d+):(\d+) is operational after recovery`), []string{"sid", "conn"}},
+	{LoginFailed, regexp.MustCompile(`(?:Login authentication failed|login rejected)`), nil},
+	{DeviceAttached, regexp.MustCompile(`sd (\d+):\d+:\d+:(\d+): \[(\w+)\] Attached SCSI`), []string{"host", "lun", "device"}},
+	{DeviceOffline, regexp.MustCompile(`sd (\d+):\d+:\d+:(\d+): (?:\[(\w+)\] )?rejecting I/O to offline device`), []string{"host", "lun", "device"}},
+	{IOError, regexp.MustCompile(`I/O error,? (?:on )?dev (\w+)`), []string{"device"}},
+	{PathFailed, regexp.MustCompile(`device-mapper: multipath: (\d+:\d+): Failing path (\d+:\d+)`), []string{"map", "device"}},
+	{PathFailed, regexp.MustCompile(`checker failed path (\d+:\d+) in map (\S+)`), []string{"device", "map"}},
+	{PathFailed, regexp.MustCompile(`([\w:]+): mark as failed`), []string{"device"}},
+	{PathReinstated, regexp.MustCompile(`device-mapper: multipath: (\d+:\d+): Reinstating path (\d+:\d+)`), []string{"map", "device"}},
+	{PathReinstated, regexp.MustCompile(`(\S+): (\w+) - \w+ checker reports path is up`), []string{"map", "device"}},
+	{PathReinstated, regexp.MustCompile(`([\w:]+): reinstated`), []string{"device"}},
+}
+
+var (
+	kmsgPrefix    = regexp.MustCompile(`^\d+,\d+,(\d+),[^;]*;`)
+	dmesgPrefix   = regexp.MustCompile(`^\[\s*(\d+)\.(\d+)\]\s*`)
+	journalPrefix = regexp.MustCompile(`^(\w{3} [ \d]\d \d\d:\d\d:\d\d|\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d[+-]\d{4}) \S+ ([\w-]+)(?:\[\d+\])?: `)
+)
+
+// ParseLine classifies a /dev/kmsg record, a dmesg line or a journalctl line in
+// the short or short-iso format. It returns nil for unrelated messages.
+func ParseLine(line string) *Event {
+	event := &Event{Source: "kernel", SID: -1, Host: -1, Lun: -1}
+	msg := strings.TrimSpace(line)
+	if m := kmsgPrefix.FindStringSubmatch(msg); m != nil {
+		usec, _ := strconv.ParseInt(m[1], 10, 64)
+		event.Uptime = time.Duration(usec) * time.Microsecond
+		msg = msg[len(m[0]):]
+	} else if m := journalPrefix.FindStringSubmatch(msg); m != nil {
+		event.Time = parseJournalTime(m[1])
+		event.Source = m[2]
+		msg = msg[len(m[0]):]
+	}
+	if m := dmesgPrefix.FindStringSubmatch(msg); m != nil {
+		sec, _ := strconv.ParseInt(m[1], 10, 64)
+		usec, _ := strconv.ParseInt((m[2] + "000000")[:6], 10, 64)
+		event.Uptime = time.Duration(sec)*time.Second + time.Duration(usec)*time.Microsecond
+		msg = msg[len(m[0]):]
+	}
+	if event.Source == "kernel" && strings.HasPrefix(msg, "iscsid: ") {
+		event.Source, msg = "iscsid", msg[len("iscsid: "):]
+	}
+
+	for _, r := range rules {
+		m := r.re.FindStringSubmatch(msg)
+		if m == nil {
+			continue
+		}
+
+		event.Kind = r.kind
+		event.Message = msg
+		for i, field := range r.fields {
+			value := m[i+1]
+			n, _ := strconv.Atoi(value)
+			switch field {
+			case "sid":
+				event.SID = n
+			case "conn":
+				event.Conn = n
+			case "code":
+				event.Code = n
+			case "host":
+				event.Host = n
+			case "lun":
+				event.Lun = n
+			case "device":
+				event.Device = value
+			case "map":
+				event.Map = value
+			}
+		}
+		return event
+	}
+
+	return nil
+}
+
+// Parse classifies the lines of r and returns the events in order.
+func Parse(r io.Reader) ([]*Event, error) {
+	var events []*Event
+	err := Scan(r, func(event *Event) {
+		events = append(events, event)
+	})
+	return events, err
+}
+
+// Scan calls fn with the event of each classified line of r until r ends.
+func Scan(r io.Reader, fn func(event *Event)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if event := ParseLine(scanner.Text()); event != nil {
+			fn(event)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// WatchKmsg sends the events of the kernel log records written to /dev/kmsg
+// from now on. The channel is closed when ctx is done or reading fails.
+func WatchKmsg(ctx context.Context) (<-chan *Event, error) {
+	file, err := os.Open("/dev/kmsg")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	events := make(chan *Event)
+	go func() {
+		<-ctx.Done()
+		file.Close()
+	}()
+	go func() {
+		defer close(events)
+
+		// Each read of /dev/kmsg returns one record
+		buf := make([]byte, 8192)
+		for {
+			n, err := file.Read(buf)
+			if err != nil {
+				return
+			}
+			event := ParseLine(string(buf[:n]))
+			if event == nil {
+				continue
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// Link sets the SID of the device events without session from sids, the
+// session IDs keyed by SCSI device kernel name.
+func Link(events []*Event, sids map[string]int) {
+	for _, event := range events {
+		if event.SID >= 0 || event.Device == "" {
+			continue
+		}
+		if sid, ok := sids[event.Device]; ok {
+			event.SID = sid
+		}
+	}
+}
+
+func parseJournalTime(s string) time.Time {
+	if t, err := time.Parse("2006-01-02T15:04:05-0700", s); err == nil {
+		return t
+	}
+
+	// The short format has no year
+	t, err := time.ParseInLocation("Jan _2 15:04:05", s, time.Local)
+	if err != nil {
+		return time.Time{}
+	}
+	now := time.Now()
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.After(now.Add(24 * time.Hour)) {
+		t = t.AddDate(-1, 0, 0)
+	}
+	return t
+}
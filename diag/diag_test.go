@@ -0,0 +1,110 @@
+// @2022 QSAN Inc. All right reserved
+
+package diag
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+type expectedEvent struct {
+	kind   Kind
+	source string
+	sid    int
+	host   int
+	device string
+}
+
+func parseFixture(t *testing.T, name string) []*Event {
+	t.Helper()
+	file, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	events, err := Parse(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return events
+}
+
+func checkEvents(t *testing.T, events []*Event, expected []expectedEvent) {
+	t.Helper()
+	if len(events) != len(expected) {
+		for _, e := range events {
+			t.Logf("%+v", e)
+		}
+		t.Fatalf("got %d events, expect %d", len(events), len(expected))
+	}
+	for i, e := range expected {
+		got := events[i]
+		if got.Kind != e.kind || got.Source != e.source || got.SID != e.sid || got.Host != e.host || got.Device != e.device {
+			t.Errorf("event %d got %s/%s sid=%d host=%d device=%s, expect %s/%s sid=%d host=%d device=%s",
+				i, got.Kind, got.Source, got.SID, got.Host, got.Device, e.kind, e.source, e.sid, e.host, e.device)
+		}
+	}
+}
+
+func TestParseKmsg(t *testing.T) {
+	events := parseFixture(t, "kmsg.txt")
+	checkEvents(t, events, []expectedEvent{
+		{DeviceAttached, "kernel", -1, 3, "sdb"},
+		{PingTimeout, "kernel", 1, -1, ""},
+		{ConnError, "kernel", 1, -1, ""},
+		{RecoveryTimeout, "kernel", 1, -1, ""},
+		{DeviceOffline, "kernel", -1, 3, ""},
+		{IOError, "kernel", -1, -1, "sdb"},
+		{PathFailed, "kernel", -1, -1, "8:16"},
+		{PathReinstated, "kernel", -1, -1, "8:16"},
+	})
+	if events[2].Code != 1022 || events[2].Uptime != 812345690*time.Microsecond {
+		t.Errorf("ConnError got code %d uptime %v", events[2].Code, events[2].Uptime)
+	}
+	if events[6].Map != "253:0" {
+		t.Errorf("PathFailed got map %q", events[6].Map)
+	}
+}
+
+func TestParseDmesg(t *testing.T) {
+	events := parseFixture(t, "dmesg.txt")
+	checkEvents(t, events, []expectedEvent{
+		{DeviceAttached, "kernel", -1, 4, "sdc"},
+		{ConnError, "kernel", 2, -1, ""},
+		{DeviceOffline, "kernel", -1, 4, "sdc"},
+		{IOError, "kernel", -1, -1, "sdc"},
+	})
+	if events[1].Code != 1020 || events[1].Uptime != 812345690*time.Microsecond {
+		t.Errorf("ConnError got code %d uptime %v", events[1].Code, events[1].Uptime)
+	}
+	if events[0].Lun != 1 {
+		t.Errorf("DeviceAttached got lun %d", events[0].Lun)
+	}
+
+	Link(events, map[string]int{"sdc": 2})
+	if events[3].SID != 2 {
+		t.Errorf("Link got sid %d, expect 2", events[3].SID)
+	}
+}
+
+func TestParseJournal(t *testing.T) {
+	events := parseFixture(t, "journal.txt")
+	checkEvents(t, events, []expectedEvent{
+		{ConnError, "kernel", 1, -1, ""},
+		{ConnError, "iscsid", 1, -1, ""},
+		{PathFailed, "multipathd", -1, -1, "sdb"},
+		{PathFailed, "multipathd", -1, -1, "8:16"},
+		{SessionRecovered, "iscsid", 1, -1, ""},
+		{PathReinstated, "multipathd", -1, -1, "sdb"},
+		{PathReinstated, "multipathd", -1, -1, "8:16"},
+		{LoginFailed, "iscsid", -1, -1, ""},
+	})
+	if events[0].Time.Month() != time.October || events[0].Time.Day() != 18 {
+		t.Errorf("journal time got %v", events[0].Time)
+	}
+	if events[7].Time.Year() != 2022 {
+		t.Errorf("short-iso time got %v", events[7].Time)
+	}
+}
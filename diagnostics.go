@@ -0,0 +1,259 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/QsanJohnson/goiscsi/diag"
+)
+
+// DiagnosticsSummary is the summary.json of a diagnostics bundle, built from
+// the collected command output and logs.
+type DiagnosticsSummary struct {
+	Time          time.Time         `json:"time" yaml:"time"`
+	Hostname      string            `json:"hostname" yaml:"hostname"`
+	InitiatorName string            `json:"initiatorName" yaml:"initiatorName"`
+	Sessions      []*Session        `json:"sessions" yaml:"sessions"`
+	Nodes         []*Node           `json:"nodes" yaml:"nodes"`
+	Ifaces        []*Iface          `json:"ifaces" yaml:"ifaces"`
+	Events        []*diag.Event     `json:"events" yaml:"events"`                     // Classified kernel and journal messages
+	EventCounts   map[diag.Kind]int `json:"eventCounts" yaml:"eventCounts"`           // Number of events by kind
+	Errors        []string          `json:"errors,omitempty" yaml:"errors,omitempty"` // Items which could not be collected
+}
+
+const (
+	diagJournalLines = "5000"
+	diagSysfsSession = "/sys/class/iscsi_session"
+)
+
+var diagSecretLine = regexp.MustCompile(`(?im)^(\s*\S*password\S*\s*[=:]\s*)\S.*$`)
+
+// diagBundle writes the entries of a diagnostics bundle into a tar stream.
+// Commands and files are read through run, readFile and glob, which tests
+// replace with fixtures.
+type diagBundle struct {
+	tw      *tar.Writer
+	now     time.Time
+	summary *DiagnosticsSummary
+
+	run      func(ctx context.Context, name string, args ...string) (string, error)
+	readFile func(path string) ([]byte, error)
+	glob     func(pattern string) ([]string, error)
+}
+
+// CollectDiagnostics writes a tar.gz bundle for support cases to w. It holds
+// the output of iscsiadm session, node and iface listings, multipath -ll and
+// lsblk, the iSCSI config files, the sysfs state of sessions and SCSI devices,
+// the kernel log and the iscsid and multipathd journal, with CHAP secrets
+// redacted. summary.json holds the parsed sessions, nodes and ifaces and the
+// classified log events. Items which cannot be collected are listed in the
+// summary, so an error is only returned when the bundle cannot be written or
+// ctx is done.
+func (iscsi *ISCSIUtil) CollectDiagnostics(ctx context.Context, w io.Writer) (err error) {
+	ctx, span := iscsi.startSpan(ctx, "CollectDiagnostics")
+	defer endSpan(span, &err)
+
+	b := &diagBundle{run: iscsi.execCmdContext, readFile: os.ReadFile, glob: filepath.Glob}
+	return iscsi.writeDiagnostics(ctx, w, b)
+}
+
+func (iscsi *ISCSIUtil) writeDiagnostics(ctx context.Context, w io.Writer, b *diagBundle) error {
+	gw := gzip.NewWriter(w)
+	b.tw = tar.NewWriter(gw)
+	b.now = time.Now()
+	b.summary = &DiagnosticsSummary{Time: b.now, EventCounts: make(map[diag.Kind]int)}
+	b.summary.Hostname, _ = os.Hostname()
+	b.summary.InitiatorName, _ = iscsi.GetInitiatorName()
+
+	if err := iscsi.collectDiagnostics(ctx, b); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(b.summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = b.write("summary.json", data); err != nil {
+		return err
+	}
+	if err = b.tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+func (iscsi *ISCSIUtil) collectDiagnostics(ctx context.Context, b *diagBundle) error {
+	out, err := b.command(ctx, "sessions.txt", "iscsiadm", "-m", "session", "-P", "3")
+	if err != nil {
+		return err
+	}
+	b.summary.Sessions = parseSessions(out)
+
+	if out, err = b.command(ctx, "nodes.txt", "iscsiadm", "-m", "node", "-o", "show"); err != nil {
+		return err
+	}
+	for _, record := range parseNodeRecords(out) {
+		b.summary.Nodes = append(b.summary.Nodes, nodeFromRecord(record))
+	}
+
+	if out, err = b.command(ctx, "ifaces.txt", "iscsiadm", "-m", "iface"); err != nil {
+		return err
+	}
+	b.summary.Ifaces = parseIfaces(out)
+
+	commands := []struct {
+		name string
+		args []string
+	}{
+		{"multipath.txt", []string{"multipath", "-ll"}},
+		{"lsblk.txt", []string{"lsblk", "-o", "NAME,KNAME,PKNAME,HCTL,TYPE,STATE,SIZE,VENDOR,MODEL,WWN,MOUNTPOINT"}},
+	}
+	for _, c := range commands {
+		if _, err := b.command(ctx, c.name, c.args[0], c.args[1:]...); err != nil {
+			return err
+		}
+	}
+
+	files := []string{iscsi.initiatorNameFile(), "/etc/iscsi/iscsid.conf", "/etc/multipath.conf"}
+	for _, path := range files {
+		if err := b.file(filepath.Join("etc", filepath.Base(path)), path); err != nil {
+			return err
+		}
+	}
+
+	if err := b.write("sysfs.txt", []byte(b.sysfsState(b.summary.Sessions))); err != nil {
+		return err
+	}
+
+	var events []*diag.Event
+	dmesg, err := b.command(ctx, "dmesg.txt", "dmesg")
+	if err != nil {
+		return err
+	}
+	journal, err := b.command(ctx, "journal.txt", "journalctl",
+		"-u", "iscsid", "-u", "multipathd", "--no-pager", "-o", "short-iso", "-n", diagJournalLines)
+	if err != nil {
+		return err
+	}
+	for _, out := range []string{dmesg, journal} {
+		parsed, _ := diag.Parse(strings.NewReader(out))
+		events = append(events, parsed...)
+	}
+
+	sids := make(map[string]int)
+	for _, sess := range b.summary.Sessions {
+		for _, scsiDev := range sess.SCSIDevices {
+			if scsiDev.Name != "" {
+				sids[scsiDev.Name] = sess.SID
+			}
+		}
+	}
+	diag.Link(events, sids)
+	for _, event := range events {
+		b.summary.EventCounts[event.Kind]++
+	}
+	b.summary.Events = events
+
+	return nil
+}
+
+// command runs a command into the entry name and returns its redacted output.
+// A failed command is recorded in the summary and its error written instead.
+func (b *diagBundle) command(ctx context.Context, name, cmd string, args ...string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	out, err := b.run(ctx, cmd, args...)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		b.summary.Errors = append(b.summary.Errors, fmt.Sprintf("%s: %s", name, strings.TrimSpace(err.Error())))
+		return "", b.write(name, []byte(err.Error()))
+	}
+
+	out = redactSecrets(out)
+	return out, b.write(name, []byte(out))
+}
+
+// file copies the redacted content of path into the entry name. A missing or
+// unreadable file is recorded in the summary.
+func (b *diagBundle) file(name, path string) error {
+	data, err := b.readFile(path)
+	if err != nil {
+		b.summary.Errors = append(b.summary.Errors, fmt.Sprintf("%s: %v", name, err))
+		return nil
+	}
+
+	return b.write(name, []byte(redactSecrets(string(data))))
+}
+
+func (b *diagBundle) write(name string, data []byte) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: b.now,
+	}
+	if err := b.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("Failed to write %s, err: %v", name, err)
+	}
+	if _, err := b.tw.Write(data); err != nil {
+		return fmt.Errorf("Failed to write %s, err: %v", name, err)
+	}
+
+	return nil
+}
+
+// sysfsState returns "path = value" lines of the sysfs attributes of iSCSI
+// sessions and of the SCSI devices of sessions.
+func (b *diagBundle) sysfsState(sessions []*Session) string {
+	var paths []string
+	dirs, _ := b.glob(filepath.Join(diagSysfsSession, "session*"))
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		for _, attr := range []string{"targetname", "state", "recovery_tmo", "abort_tmo", "lu_reset_tmo"} {
+			paths = append(paths, filepath.Join(dir, attr))
+		}
+	}
+	for _, sess := range sessions {
+		for _, scsiDev := range sess.SCSIDevices {
+			if scsiDev.Name == "" {
+				continue
+			}
+			for _, attr := range []string{"device/state", "device/timeout", "device/queue_depth", "size"} {
+				paths = append(paths, filepath.Join("/sys/block", scsiDev.Name, attr))
+			}
+		}
+	}
+
+	var sb strings.Builder
+	for _, path := range paths {
+		value := "<unreadable>"
+		if data, err := b.readFile(path); err == nil {
+			value = strings.TrimSpace(string(data))
+		}
+		fmt.Fprintf(&sb, "%s = %s\n", path, value)
+	}
+
+	return sb.String()
+}
+
+// redactSecrets replaces the values of password settings in out, e.g. the
+// node.session.auth.password lines of node records and iscsid.conf.
+func redactSecrets(out string) string {
+	return diagSecretLine.ReplaceAllString(out, "${1}<redacted>")
+}
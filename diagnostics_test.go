@@ -0,0 +1,180 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/QsanJohnson/goiscsi/diag"
+)
+
+func TestRedactSecrets(t *testing.T) {
+	in := strings.Join([]string{
+		"node.session.auth.username = johnson",
+		"node.session.auth.password = 111122223333",
+		"#node.session.auth.password_in = secret",
+		"\t\tpassword: 111122223333",
+		"# To set a CHAP username and password for initiator",
+	}, "\n")
+	expected := strings.Join([]string{
+		"node.session.auth.username = johnson",
+		"node.session.auth.password = <redacted>",
+		"#node.session.auth.password_in = <redacted>",
+		"\t\tpassword: <redacted>",
+		"# To set a CHAP username and password for initiator",
+	}, "\n")
+
+	if out := redactSecrets(in); out != expected {
+		t.Errorf("redactSecrets got\n%s\nexpect\n%s", out, expected)
+	}
+}
+
+func TestCollectDiagnostics(t *testing.T) {
+	iscsi := &ISCSIUtil{Opts: ISCSIOptions{InitiatorNameFile: "testdata/diag/initiatorname.iscsi"}}
+	commands := map[string]string{
+		"iscsiadm -m session -P 3": "testdata/session_p3.txt",
+		"iscsiadm -m node -o show": "testdata/node_record.txt",
+		"lsblk":                    "testdata/lsblk_topology.txt",
+		"dmesg":                    "diag/testdata/dmesg.txt",
+		"journalctl":               "diag/testdata/journal.txt",
+	}
+	files := map[string]string{
+		"testdata/diag/initiatorname.iscsi":            "testdata/diag/initiatorname.iscsi",
+		"/etc/iscsi/iscsid.conf":                       "testdata/diag/iscsid.conf",
+		"/sys/class/iscsi_session/session1/state":      "LOGGED_IN\n",
+		"/sys/class/iscsi_session/session3/state":      "FAILED\n",
+		"/sys/block/sdc/device/state":                  "offline\n",
+		"/sys/class/iscsi_session/session1/targetname": "iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr1\n",
+	}
+
+	var ran []string
+	b := &diagBundle{
+		run: func(ctx context.Context, name string, args ...string) (string, error) {
+			cmd := strings.Join(append([]string{name}, args...), " ")
+			ran = append(ran, cmd)
+			switch {
+			case cmd == "iscsiadm -m iface":
+				return "default tcp,<empty>,<empty>,<empty>,<empty>\n", nil
+			case name == "multipath":
+				return "", fmt.Errorf("exit status 1")
+			}
+			for prefix, fixture := range commands {
+				if cmd == prefix || (!strings.Contains(prefix, " ") && name == prefix) {
+					data, err := os.ReadFile(fixture)
+					return string(data), err
+				}
+			}
+			return "", fmt.Errorf("unexpected command %s", cmd)
+		},
+		readFile: func(path string) ([]byte, error) {
+			value, ok := files[path]
+			if !ok {
+				return nil, os.ErrNotExist
+			}
+			if strings.HasPrefix(value, "testdata/") {
+				return os.ReadFile(value)
+			}
+			return []byte(value), nil
+		},
+		glob: func(pattern string) ([]string, error) {
+			return []string{"/sys/class/iscsi_session/session3", "/sys/class/iscsi_session/session1"}, nil
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := iscsi.writeDiagnostics(context.Background(), &buf, b); err != nil {
+		t.Fatal(err)
+	}
+
+	gr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	entries := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(tr)
+		entries[hdr.Name] = string(data)
+	}
+
+	sessions, _ := os.ReadFile("testdata/session_p3.txt")
+	if entries["sessions.txt"] != redactSecrets(string(sessions)) || !strings.Contains(entries["sessions.txt"], "\t\tpassword: <redacted>\n") {
+		t.Errorf("sessions.txt does not hold the redacted iscsiadm output")
+	}
+	if !strings.Contains(entries["multipath.txt"], "exit status 1") {
+		t.Errorf("multipath.txt got %q, expect the command error", entries["multipath.txt"])
+	}
+	if conf := entries["etc/iscsid.conf"]; strings.Contains(conf, "111122223333") || !strings.Contains(conf, "node.session.auth.password = <redacted>") {
+		t.Errorf("etc/iscsid.conf is not redacted:\n%s", conf)
+	}
+	if !strings.Contains(entries["etc/initiatorname.iscsi"], "iqn.1993-08.org.debian:01:4f3a9b2c1d0e") {
+		t.Errorf("etc/initiatorname.iscsi got %q", entries["etc/initiatorname.iscsi"])
+	}
+	for _, line := range []string{
+		"/sys/class/iscsi_session/session1/state = LOGGED_IN",
+		"/sys/class/iscsi_session/session1/recovery_tmo = <unreadable>",
+		"/sys/class/iscsi_session/session3/state = FAILED",
+		"/sys/block/sdc/device/state = offline",
+	} {
+		if !strings.Contains(entries["sysfs.txt"], line+"\n") {
+			t.Errorf("sysfs.txt does not contain %q:\n%s", line, entries["sysfs.txt"])
+		}
+	}
+	if strings.Index(entries["sysfs.txt"], "session1/") > strings.Index(entries["sysfs.txt"], "session3/") {
+		t.Errorf("sysfs.txt sessions are not sorted")
+	}
+	if len(ran) != 7 || ran[len(ran)-1] != "journalctl -u iscsid -u multipathd --no-pager -o short-iso -n 5000" {
+		t.Errorf("unexpected commands %q", ran)
+	}
+
+	for _, key := range []string{`"initiatorName": "iqn.1993-08.org.debian:01:4f3a9b2c1d0e"`, `"eventCounts"`, `"sessions"`} {
+		if !strings.Contains(entries["summary.json"], key) {
+			t.Errorf("summary.json does not contain %s", key)
+		}
+	}
+	var summary DiagnosticsSummary
+	if err := json.Unmarshal([]byte(entries["summary.json"]), &summary); err != nil {
+		t.Fatalf("Failed to decode summary, err: %v", err)
+	}
+	if summary.Time.IsZero() {
+		t.Errorf("Summary time is not set")
+	}
+	if len(summary.Sessions) != 3 || summary.Sessions[2].State != "FAILED" {
+		t.Errorf("Summary got %d sessions, expect 3", len(summary.Sessions))
+	}
+	if len(summary.Nodes) != 2 || summary.Nodes[1].Target != "iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr2" {
+		t.Errorf("Summary got nodes %+v", summary.Nodes)
+	}
+	if len(summary.Ifaces) != 1 || summary.Ifaces[0].Name != "default" || summary.Ifaces[0].Transport != "tcp" {
+		t.Errorf("Summary got ifaces %+v", summary.Ifaces)
+	}
+	if len(summary.Errors) != 2 || !strings.HasPrefix(summary.Errors[0], "multipath.txt: ") || !strings.HasPrefix(summary.Errors[1], "etc/multipath.conf: ") {
+		t.Errorf("Summary got errors %q, expect multipath.txt and etc/multipath.conf", summary.Errors)
+	}
+
+	// The I/O error on sdc of the kernel log is linked to session 1 of sdc
+	if summary.EventCounts[diag.IOError] != 1 || summary.EventCounts[diag.ConnError] == 0 {
+		t.Errorf("Summary got event counts %v", summary.EventCounts)
+	}
+	for _, event := range summary.Events {
+		if event.Kind == diag.IOError && (event.Device != "sdc" || event.SID != 1) {
+			t.Errorf("IOError event got device %s sid %d, expect sdc sid 1", event.Device, event.SID)
+		}
+	}
+}
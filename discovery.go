@@ -0,0 +1,119 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/QsanJohnson/goiscsi/iscsiname"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Discover returns the targets offered by portal through SendTargets discovery,
+// one per target portal, with Lun 0. chap may be nil. Discovered node records
+// are not stored, Login creates them. The discovery record holding the CHAP
+// secret is deleted afterwards, or has its auth settings restored if it
+// existed before.
+func (iscsi *ISCSIUtil) Discover(ctx context.Context, portal string, chap *Chap) (_ []*Target, err error) {
+	ctx, span := iscsi.startSpan(ctx, "Discover", attribute.String("iscsi.portal", portal))
+	defer endSpan(span, &err)
+	if _, err := iscsiname.ParsePortal(portal); err != nil {
+		return nil, fmt.Errorf("Invalid portal, err: %v", err)
+	}
+
+	ctx, cancel := iscsi.withTimeout(ctx)
+	defer cancel()
+
+	baseArgs := []string{"-m", "discoverydb", "-t", "sendtargets", "-p", canonicalPortal(portal)}
+	var out string
+	if chap == nil {
+		out, err = iscsi.execCmdContext(ctx, "iscsiadm", "-m", "discovery", "-t", "sendtargets",
+			"-p", canonicalPortal(portal), "-o", "nonpersistent")
+	} else {
+		var undo func()
+		if undo, err = iscsi.discoveryRecord(ctx, portal, baseArgs); err != nil {
+			return nil, err
+		}
+		defer undo()
+		if _, err = iscsi.execCmd(ctx, "iscsiadm", append(baseArgs, "-o", "update",
+			"-n", "discovery.sendtargets.auth.authmethod", "-v", "CHAP",
+			"-n", "discovery.sendtargets.auth.username", "-v", chap.User,
+			"-n", "discovery.sendtargets.auth.password", "-v", chap.Passwd)...); err != nil {
+			return nil, fmt.Errorf("Failed to set discovery CHAP config, err: %v", err)
+		}
+		out, err = iscsi.execCmdContext(ctx, "iscsiadm", append(baseArgs, "--discover", "-o", "nonpersistent")...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to discover %s, err: %v", portal, err)
+	}
+
+	targets := parseDiscovery(out)
+	iscsi.logger().V(1).Info("Discovered", "portal", portal, "targetCnt", len(targets))
+	return targets, nil
+}
+
+// discoveryRecord makes sure the discovery record of baseArgs exists before its
+// CHAP settings are updated, and returns the function undoing the update. A
+// record created here is deleted, while the auth settings of an existing
+// record are restored, so that its other settings are left alone.
+func (iscsi *ISCSIUtil) discoveryRecord(ctx context.Context, portal string, baseArgs []string) (func(), error) {
+	if out, err := iscsi.execCmd(ctx, "iscsiadm", append(baseArgs, "-o", "show", "-S")...); err == nil {
+		args := discoveryAuthArgs(parseNodeRecords(out))
+		return func() {
+			if len(args) == 0 {
+				return
+			}
+			if _, err := iscsi.execCmd(ctx, "iscsiadm", append(append(baseArgs, "-o", "update"), args...)...); err != nil {
+				iscsi.logger().Info("Failed to restore discovery record", "portal", portal, "err", err)
+			}
+		}, nil
+	}
+
+	if _, err := iscsi.execCmd(ctx, "iscsiadm", append(baseArgs, "-o", "new")...); err != nil {
+		return nil, fmt.Errorf("Failed to new discovery record, err: %v", err)
+	}
+	return func() {
+		if _, err := iscsi.execCmd(ctx, "iscsiadm", append(baseArgs, "-o", "delete")...); err != nil {
+			iscsi.logger().Info("Failed to delete discovery record", "portal", portal, "err", err)
+		}
+	}, nil
+}
+
+// discoveryAuthArgs returns the update arguments setting the sendtargets auth
+// settings of a discovery record back to their values in records.
+func discoveryAuthArgs(records []map[string]string) []string {
+	if len(records) == 0 {
+		return nil
+	}
+
+	var keys []string
+	for key := range records[0] {
+		if strings.HasPrefix(key, "discovery.sendtargets.auth.") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var args []string
+	for _, key := range keys {
+		args = append(args, "-n", key, "-v", records[0][key])
+	}
+	return args
+}
+
+// parseDiscovery parses the "portal,tpgt name" lines of iscsiadm discovery output.
+func parseDiscovery(out string) []*Target {
+	var targets []*Target
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || iscsiname.Validate(fields[1]) != nil {
+			continue
+		}
+		targets = append(targets, &Target{Portal: canonicalPortal(fields[0]), Name: fields[1]})
+	}
+
+	return targets
+}
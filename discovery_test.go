@@ -0,0 +1,92 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseDiscovery(t *testing.T) {
+	out := "192.168.206.50:3260,1 iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr1\n" +
+		"[fe80::1]:3260,2 iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr2\n" +
+		"iscsiadm: No portals found\n"
+
+	targets := parseDiscovery(out)
+	expected := []Target{
+		{Portal: "192.168.206.50:3260", Name: "iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr1"},
+		{Portal: "[fe80::1]:3260", Name: "iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr2"},
+	}
+	if len(targets) != len(expected) {
+		t.Fatalf("parseDiscovery got %d targets, expect %d", len(targets), len(expected))
+	}
+	for i, target := range targets {
+		if target.Portal != expected[i].Portal || target.Name != expected[i].Name {
+			t.Errorf("parseDiscovery got %s %s, expect %s %s", target.Portal, target.Name, expected[i].Portal, expected[i].Name)
+		}
+	}
+}
+
+// fakeDiscoveryIscsiadm puts an iscsiadm on PATH which logs its arguments,
+// shows the discovery record if exists is set and discovers one target.
+func fakeDiscoveryIscsiadm(t *testing.T, exists bool) string {
+	dir := t.TempDir()
+	show := `echo "iscsiadm: Discovery record not found"; exit 21`
+	if exists {
+		show = `printf '# BEGIN RECORD 2.1.5\ndiscovery.startup = automatic\ndiscovery.sendtargets.auth.authmethod = CHAP\n` +
+			`discovery.sendtargets.auth.username = admin\ndiscovery.sendtargets.auth.password = adminpasswd\n# END RECORD\n'`
+	}
+	script := "#!/bin/sh\n" +
+		"echo \"$*\" >> " + filepath.Join(dir, "args") + "\n" +
+		"case \"$*\" in\n" +
+		"*\"-o show\"*) " + show + " ;;\n" +
+		"*--discover*) echo '192.168.206.50:3260,1 iqn.2004-08.com.qsan:dev3.ctr1' ;;\n" +
+		"esac\n"
+	if err := os.WriteFile(filepath.Join(dir, "iscsiadm"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	return filepath.Join(dir, "args")
+}
+
+func TestDiscoverCHAPRecord(t *testing.T) {
+	chap := &Chap{User: "johnson", Passwd: "111122223333"}
+
+	// A record created by Discover is deleted
+	argsFile := fakeDiscoveryIscsiadm(t, false)
+	targets, err := (&ISCSIUtil{}).Discover(context.Background(), "192.168.206.50", chap)
+	if err != nil || len(targets) != 1 {
+		t.Fatalf("Discover got %v, %v", targets, err)
+	}
+	data, _ := os.ReadFile(argsFile)
+	if !strings.Contains(string(data), "-o new") || !strings.Contains(string(data), "-o delete") {
+		t.Fatalf("new record should be created and deleted:\n%s", data)
+	}
+
+	// An existing record is kept with its auth settings restored
+	argsFile = fakeDiscoveryIscsiadm(t, true)
+	if _, err := (&ISCSIUtil{}).Discover(context.Background(), "192.168.206.50", chap); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = os.ReadFile(argsFile)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if strings.Contains(string(data), "-o new") || strings.Contains(string(data), "-o delete") {
+		t.Fatalf("existing record should be kept:\n%s", data)
+	}
+	restore := "-o update -n discovery.sendtargets.auth.authmethod -v CHAP " +
+		"-n discovery.sendtargets.auth.password -v adminpasswd -n discovery.sendtargets.auth.username -v admin"
+	if last := lines[len(lines)-1]; !strings.HasSuffix(last, restore) {
+		t.Fatalf("auth settings are not restored: %s", last)
+	}
+}
+
+func TestRedactOutput(t *testing.T) {
+	out := "discovery.sendtargets.auth.username = admin\ndiscovery.sendtargets.auth.password = adminpasswd\n"
+	redacted := redactOutput(out)
+	if strings.Contains(redacted, "adminpasswd") || !strings.Contains(redacted, "username = admin") {
+		t.Fatalf("unexpected redacted output: %q", redacted)
+	}
+}
@@ -0,0 +1,83 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// StateVersion is the version of the State encoding. Decoding accepts states
+// of the same major version, "goiscsi/v1".
+const StateVersion = "goiscsi/v1"
+
+// State is the versioned document of goiscsi objects exported to other
+// systems, e.g. a host inventory. CHAP passwords are never encoded.
+type State struct {
+	Version  string           `json:"version" yaml:"version"`
+	Time     time.Time        `json:"time" yaml:"time"`
+	Host     string           `json:"host,omitempty" yaml:"host,omitempty"`
+	Targets  []*Target        `json:"targets,omitempty" yaml:"targets,omitempty"`
+	Sessions []*Session       `json:"sessions,omitempty" yaml:"sessions,omitempty"`
+	Disks    map[string]*Disk `json:"disks,omitempty" yaml:"disks,omitempty"` // Disks by volume ID
+}
+
+// MarshalState encodes s as JSON, or as YAML if yamlFormat is set. The
+// version is set to StateVersion and the time to now if it is zero. CHAP
+// passwords of the targets are left out, s is not modified.
+func MarshalState(s *State, yamlFormat bool) ([]byte, error) {
+	out := *s
+	out.Version = StateVersion
+	if out.Time.IsZero() {
+		out.Time = time.Now()
+	}
+	out.Targets = make([]*Target, len(s.Targets))
+	for i, target := range s.Targets {
+		t := *target
+		if t.Chap != nil {
+			t.Chap = &Chap{User: t.Chap.User}
+		}
+		out.Targets[i] = &t
+	}
+
+	if yamlFormat {
+		return yaml.Marshal(&out)
+	}
+	return json.MarshalIndent(&out, "", "  ")
+}
+
+// UnmarshalState decodes a JSON or YAML state and checks its version.
+func UnmarshalState(data []byte) (*State, error) {
+	s := &State{}
+	var err error
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "{") {
+		err = json.Unmarshal(data, s)
+	} else {
+		err = yaml.Unmarshal(data, s)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode state, err: %v", err)
+	}
+
+	if err := checkStateVersion(s.Version); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// checkStateVersion accepts versions of the StateVersion major version, such
+// as "goiscsi/v1" or "goiscsi/v1.2".
+func checkStateVersion(version string) error {
+	if version == "" {
+		return fmt.Errorf("State version is missing")
+	}
+	if version != StateVersion && !strings.HasPrefix(version, StateVersion+".") {
+		return fmt.Errorf("Unsupported state version %s, expect %s", version, StateVersion)
+	}
+
+	return nil
+}
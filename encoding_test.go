@@ -0,0 +1,106 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestChapRedaction(t *testing.T) {
+	target := &Target{Portal: "192.168.206.50:3260", Name: "iqn.2004-08.com.qsan:dev3.ctr1", Chap: &Chap{User: "johnson", Passwd: "111122223333"}}
+
+	// Targets, and results and events holding them, do not encode the password
+	for _, v := range []interface{}{target, &TargetResult{Target: target}, &Event{Target: target}} {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "111122223333") || !strings.Contains(string(data), `"user":"johnson"`) {
+			t.Errorf("JSON got %s", data)
+		}
+		data, err = yaml.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "111122223333") || !strings.Contains(string(data), "user: johnson") {
+			t.Errorf("YAML got %s", data)
+		}
+	}
+
+	// Nor do states
+	var data []byte
+	var err error
+	for _, yamlFormat := range []bool{false, true} {
+		data, err = MarshalState(&State{Targets: []*Target{target}}, yamlFormat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "111122223333") || !strings.Contains(string(data), "johnson") {
+			t.Errorf("MarshalState got %s", data)
+		}
+	}
+	if target.Chap.Passwd == "" {
+		t.Errorf("MarshalState should not modify the target")
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	state := &State{
+		Time: time.Date(2022, 10, 18, 10, 0, 0, 0, time.UTC),
+		Host: "node1",
+		Targets: []*Target{
+			{Portal: "[fe80::1]:3260", Name: "iqn.2004-08.com.qsan:dev3.ctr1", Lun: 1, Chap: &Chap{User: "johnson", Passwd: "111122223333"}, Iface: "eth1-iface", Startup: StartupAutomatic},
+		},
+		Sessions: []*Session{
+			{SID: 3, Portal: "[fe80::1]:3260", Target: "iqn.2004-08.com.qsan:dev3.ctr1", State: "LOGGED_IN", Iface: "default",
+				SCSIDevices: []*SCSIDevice{{Lun: 1, Name: "sdb", State: "running"}}},
+		},
+		Disks: map[string]*Disk{
+			"vol1": {Valid: true, Status: "online", Name: "dm-0", Size: "10G", Serial: "32000d42f58", MpathCnt: 1, DiskCnt: 1,
+				Devices: map[string]*Device{"sdb": {Name: "sdb", Type: "disk", State: "running", Size: "10G"}}},
+		},
+	}
+
+	expected := *state
+	expected.Version = StateVersion
+	expected.Targets = []*Target{{Portal: "[fe80::1]:3260", Name: "iqn.2004-08.com.qsan:dev3.ctr1", Lun: 1, Chap: &Chap{User: "johnson"}, Iface: "eth1-iface", Startup: StartupAutomatic}}
+
+	for _, yamlFormat := range []bool{false, true} {
+		data, err := MarshalState(state, yamlFormat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := UnmarshalState(data)
+		if err != nil {
+			t.Fatalf("UnmarshalState failed: %v\n%s", err, data)
+		}
+		if !reflect.DeepEqual(decoded, &expected) {
+			t.Errorf("Round trip (yaml=%v) got unexpected state\n%s", yamlFormat, data)
+		}
+	}
+}
+
+func TestUnmarshalStateVersion(t *testing.T) {
+	tests := []struct {
+		data  string
+		valid bool
+	}{
+		{`{"version": "goiscsi/v1", "time": "2022-10-18T10:00:00Z"}`, true},
+		{"version: goiscsi/v1.1\nsessions:\n- sid: 1\n", true},
+		{`{"version": "goiscsi/v2"}`, false},
+		{`{"version": "goiscsi/v10"}`, false},
+		{`{"sessions": []}`, false},
+	}
+
+	for _, tt := range tests {
+		if _, err := UnmarshalState([]byte(tt.data)); (err == nil) != tt.valid {
+			t.Errorf("UnmarshalState(%s) got err %v", tt.data, err)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type HealActionType string
+
+const (
+	HealLogin     HealActionType = "login"     // Log in a target without session
+	HealRelogin   HealActionType = "relogin"   // Log out and in a target whose session stays failed
+	HealRescan    HealActionType = "rescan"    // Rescan a session missing the target LUN
+	HealReinstate HealActionType = "reinstate" // Bring an offline SCSI device or failed multipath path back
+)
+
+const (
+	defaultHealInterval      = 30 * time.Second
+	defaultHealFailedTimeout = 2 * time.Minute
+	defaultHealBackoff       = time.Minute
+	defaultHealFlapWindow    = 10 * time.Minute
+	defaultHealFlapThreshold = 5
+
+	mpathPathFailed = "failed" // dm state of a multipath path failed by multipathd
+)
+
+type HealerOptions struct {
+	Interval      time.Duration // Interval between heal rounds, default is 30 seconds
+	FailedTimeout time.Duration // How long a session may stay FAILED or FREE before relogin, default is 2 minutes
+	Backoff       time.Duration // Minimum delay between two actions on the same target, default is 1 minute
+	FlapWindow    time.Duration // Window of the flap detection, default is 10 minutes
+	FlapThreshold int           // Actions on a target within FlapWindow after which it is left alone, default is 5
+	MaxTargets    int           // Maximum targets healed per round, unlimited if zero
+}
+
+// HealAction is an action of a heal round. Flapping actions are not run since
+// their target was healed too often recently; Err is the result otherwise.
+type HealAction struct {
+	VolumeID string
+	Target   *Target
+	Type     HealActionType
+	SID      int    // Session of rescan actions
+	Device   string // SCSI device of reinstate actions
+	Flapping bool
+	Err      error
+
+	resolved *Target
+}
+
+// Healer keeps the sessions and paths of volumes up. Each round it re-logs in
+// targets without session or whose session stays failed, rescans sessions
+// missing the volume LUN and reinstates offline SCSI devices as well as failed
+// multipath paths of running devices. Actions on a target are rate limited and
+// stopped while the target flaps.
+type Healer struct {
+	iscsi   *ISCSIUtil
+	volumes []*Volume
+	opts    HealerOptions
+
+	mu          sync.Mutex
+	failedSince map[string]time.Time   // First round a target session was seen failed
+	history     map[string][]time.Time // Recent action times by target
+}
+
+// NewHealer returns a healer of volumes. opts may be nil for the defaults.
+func (iscsi *ISCSIUtil) NewHealer(volumes []*Volume, opts *HealerOptions) (*Healer, error) {
+	for _, vol := range volumes {
+		if err := validateTargets(vol.Targets); err != nil {
+			return nil, fmt.Errorf("Invalid volume %s, err: %v", vol.ID, err)
+		}
+	}
+
+	h := &Healer{
+		iscsi:       iscsi,
+		volumes:     volumes,
+		failedSince: make(map[string]time.Time),
+		history:     make(map[string][]time.Time),
+	}
+	if opts != nil {
+		h.opts = *opts
+	}
+	if h.opts.Interval <= 0 {
+		h.opts.Interval = defaultHealInterval
+	}
+	if h.opts.FailedTimeout <= 0 {
+		h.opts.FailedTimeout = defaultHealFailedTimeout
+	}
+	if h.opts.Backoff <= 0 {
+		h.opts.Backoff = defaultHealBackoff
+	}
+	if h.opts.FlapWindow <= 0 {
+		h.opts.FlapWindow = defaultHealFlapWindow
+	}
+	if h.opts.FlapThreshold <= 0 {
+		h.opts.FlapThreshold = defaultHealFlapThreshold
+	}
+
+	return h, nil
+}
+
+// Run heals the volumes every HealerOptions.Interval until ctx is done.
+func (h *Healer) Run(ctx context.Context) error {
+	ticker := time.NewTicker(h.opts.Interval)
+	defer ticker.Stop()
+	for {
+		h.Heal(ctx)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Heal runs one heal round and returns its actions. The round is skipped if
+// the sessions cannot be listed, since every target would look logged out.
+func (h *Healer) Heal(ctx context.Context) []*HealAction {
+	ctx, span := h.iscsi.startSpan(ctx, "Heal")
+	var err error
+	defer endSpan(span, &err)
+
+	sessions, err := h.iscsi.freshSessions(ctx)
+	if err != nil {
+		h.iscsi.logger().Error(err, "Failed to get session, skip heal round")
+		return nil
+	}
+	actions := h.plan(ctx, sessions, h.iscsi.multipathPathStates(ctx), time.Now())
+	for _, action := range actions {
+		if action.Flapping {
+			h.iscsi.logger().Info("Target is flapping, skip healing", append(targetValues(action.resolved), "action", action.Type)...)
+			continue
+		}
+		if action.Err = ctx.Err(); action.Err != nil {
+			break
+		}
+
+		action.Err = h.run(ctx, action)
+		log := h.iscsi.logger().WithValues(append(targetValues(action.resolved), "volume", action.VolumeID, "action", action.Type, "device", action.Device)...)
+		if action.Err != nil {
+			log.Error(action.Err, "Failed to heal")
+		} else {
+			log.V(1).Info("Healed")
+		}
+	}
+	if len(actions) > 0 {
+		h.iscsi.InvalidateSessionCache()
+	}
+
+	return actions
+}
+
+func (h *Healer) run(ctx context.Context, action *HealAction) error {
+	switch action.Type {
+	case HealLogin:
+		_, err := h.iscsi.loginTarget(ctx, action.resolved)
+		return err
+	case HealRelogin:
+		if err := h.iscsi.logoutTarget(ctx, action.resolved); err != nil {
+			return err
+		}
+		_, err := h.iscsi.loginTarget(ctx, action.resolved)
+		return err
+	case HealRescan:
+		return h.iscsi.rescanSessionByID(ctx, action.SID)
+	case HealReinstate:
+		if err := writeDeviceFile(fmt.Sprintf("/sys/block/%s/device/state", action.Device), "running\n"); err != nil {
+			return err
+		}
+		if _, err := h.iscsi.execCmd(ctx, "multipathd", "reinstate", "path", action.Device); err != nil {
+			return fmt.Errorf("Failed to reinstate path %s, err: %v", action.Device, err)
+		}
+	}
+
+	return nil
+}
+
+// plan returns the actions of a heal round given the current sessions and the
+// dm states of multipath paths by device. The actions are recorded for rate
+// limiting and flap detection as if they ran.
+func (h *Healer) plan(ctx context.Context, sessions []*Session, paths map[string]string, now time.Time) []*HealAction {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var actions []*HealAction
+	seen := make(map[string]bool)
+	add := func(action *HealAction, key string) {
+		if seen[string(action.Type)+","+key] {
+			return
+		}
+		seen[string(action.Type)+","+key] = true
+		actions = append(actions, action)
+	}
+
+	for _, vol := range h.volumes {
+		for i, target := range h.iscsi.resolveTargets(ctx, sessions, vol.Targets) {
+			key := targetLockKey(target)
+			newAction := func(typ HealActionType) *HealAction {
+				return &HealAction{VolumeID: vol.ID, Target: vol.Targets[i], Type: typ, resolved: target}
+			}
+
+			cnt, _ := targetSessionCount(sessions, target)
+			if cnt == 0 {
+				add(newAction(HealLogin), key)
+				continue
+			}
+
+			var failed bool
+			for _, sess := range sessions {
+				if !sessionOfTarget(sess, target) {
+					continue
+				}
+				if sess.State != sessionStateLoggedIn {
+					failed = true
+					continue
+				}
+
+				lunFound := false
+				for _, scsiDev := range sess.SCSIDevices {
+					if scsiDev.Lun != target.Lun {
+						continue
+					}
+					lunFound = true
+					if scsiDev.Name != "" && (scsiDev.State == "offline" || scsiDev.State == "running" && paths[scsiDev.Name] == mpathPathFailed) {
+						action := newAction(HealReinstate)
+						action.Device = scsiDev.Name
+						add(action, scsiDev.Name)
+					}
+				}
+				if !lunFound {
+					action := newAction(HealRescan)
+					action.SID = sess.SID
+					add(action, fmt.Sprint(sess.SID))
+				}
+			}
+
+			if !failed {
+				delete(h.failedSince, key)
+			} else if since, ok := h.failedSince[key]; !ok {
+				h.failedSince[key] = now
+			} else if now.Sub(since) >= h.opts.FailedTimeout {
+				add(newAction(HealRelogin), key)
+			}
+		}
+	}
+
+	// The failure is cleared once a login is going to run, so a relogin
+	// dropped by limit is planned again next round.
+	actions = h.limit(actions, now)
+	for _, action := range actions {
+		if !action.Flapping && (action.Type == HealLogin || action.Type == HealRelogin) {
+			delete(h.failedSince, targetLockKey(action.resolved))
+		}
+	}
+
+	return actions
+}
+
+// limit drops the actions on targets healed within Backoff and beyond
+// MaxTargets, flags those on flapping targets and records the others.
+func (h *Healer) limit(actions []*HealAction, now time.Time) []*HealAction {
+	var allowed []*HealAction
+	acted := make(map[string]bool)
+	for _, action := range actions {
+		key := targetLockKey(action.resolved)
+		var recent []time.Time
+		for _, t := range h.history[key] {
+			if now.Sub(t) < h.opts.FlapWindow {
+				recent = append(recent, t)
+			}
+		}
+		h.history[key] = recent
+
+		if len(recent) >= h.opts.FlapThreshold {
+			action.Flapping = true
+			allowed = append(allowed, action)
+			continue
+		}
+		if !acted[key] && len(recent) > 0 && now.Sub(recent[len(recent)-1]) < h.opts.Backoff {
+			continue
+		}
+		if h.opts.MaxTargets > 0 && len(acted) >= h.opts.MaxTargets && !acted[key] {
+			continue
+		}
+
+		if !acted[key] {
+			acted[key] = true
+			h.history[key] = append(recent, now)
+		}
+		allowed = append(allowed, action)
+	}
+
+	return allowed
+}
+
+// multipathPathStates returns the dm states of multipath paths by device
+// name, such as "active" or "failed", or nil without multipathd.
+func (iscsi *ISCSIUtil) multipathPathStates(ctx context.Context) map[string]string {
+	out, err := iscsi.execCmd(ctx, "multipathd", "show", "paths", "raw", "format", "%d %t")
+	if err != nil {
+		iscsi.logger().V(2).Info("Failed to get multipath paths", "err", err)
+		return nil
+	}
+
+	return parseMultipathPathStates(out)
+}
+
+// parseMultipathPathStates parses `multipathd show paths raw format "%d %t"`
+// output, one "device dm_state" line per path.
+func parseMultipathPathStates(out string) map[string]string {
+	paths := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			paths[fields[0]] = fields[1]
+		}
+	}
+
+	return paths
+}
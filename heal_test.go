@@ -0,0 +1,177 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHealerPlan(t *testing.T) {
+	out, err := os.ReadFile("testdata/session_p3.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := parseSessions(string(out))
+	sessions[0].SCSIDevices[1].State = "offline" // sdc
+
+	volumes := []*Volume{
+		{ID: "vol1", Targets: []*Target{{Portal: "192.168.206.50", Name: "iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr1", Lun: 1, Iface: "default"}}},
+		{ID: "vol2", Targets: []*Target{{Portal: "[fe80::1]", Name: "iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr2", Lun: 0}}},
+		{ID: "vol3", Targets: []*Target{
+			{Portal: "192.168.206.50", Name: "iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr1", Lun: 2, Iface: "eth1-iface"},
+			{Portal: "192.168.206.51", Name: "iqn.2004-08.com.qsan:xf2026-000d42f58:dev4.ctr1", Lun: 2},
+		}},
+		{ID: "vol4", Targets: []*Target{{Portal: "192.168.206.50", Name: "iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr1", Lun: 0, Iface: "default"}}},
+	}
+	// sdb is running but its multipath path failed, sdd is an active path
+	paths := parseMultipathPathStates("sdb failed\nsdd active\nsdx active\n")
+	opts := &HealerOptions{FailedTimeout: time.Minute, Backoff: time.Minute, FlapWindow: 10 * time.Minute, FlapThreshold: 2}
+	h, err := (&ISCSIUtil{}).NewHealer(volumes, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	actions := h.plan(context.Background(), sessions, paths, now)
+	type healCase struct {
+		vol    string
+		typ    HealActionType
+		detail string
+	}
+	expected := []healCase{
+		{"vol1", HealReinstate, "sdc"},
+		{"vol3", HealRescan, "2"},
+		{"vol3", HealLogin, ""},
+		{"vol4", HealReinstate, "sdb"},
+	}
+	checkActions := func(actions []*HealAction) {
+		t.Helper()
+		if len(actions) != len(expected) {
+			for _, a := range actions {
+				t.Logf("%s %s sid=%d device=%s flapping=%v", a.VolumeID, a.Type, a.SID, a.Device, a.Flapping)
+			}
+			t.Fatalf("got %d actions, expect %d", len(actions), len(expected))
+		}
+		for i, e := range expected {
+			a := actions[i]
+			detail := a.Device
+			if a.Type == HealRescan {
+				detail = "2"
+				if a.SID != 2 {
+					detail = ""
+				}
+			}
+			if a.VolumeID != e.vol || a.Type != e.typ || detail != e.detail {
+				t.Errorf("action %d got %s %s sid=%d device=%s, expect %s %s %s", i, a.VolumeID, a.Type, a.SID, a.Device, e.vol, e.typ, e.detail)
+			}
+		}
+	}
+	checkActions(actions)
+
+	// Within the backoff nothing is done, the failed session of vol2 is not
+	// timed out yet.
+	if actions := h.plan(context.Background(), sessions, paths, now.Add(30*time.Second)); len(actions) != 0 {
+		t.Fatalf("got %d actions within backoff, expect 0", len(actions))
+	}
+
+	expected = []healCase{
+		{"vol1", HealReinstate, "sdc"},
+		{"vol2", HealRelogin, ""},
+		{"vol3", HealRescan, "2"},
+		{"vol3", HealLogin, ""},
+		{"vol4", HealReinstate, "sdb"},
+	}
+	checkActions(h.plan(context.Background(), sessions, paths, now.Add(2*time.Minute)))
+
+	// The third round of the same targets within the flap window is flagged
+	actions = h.plan(context.Background(), sessions, paths, now.Add(4*time.Minute))
+	if len(actions) != 4 {
+		t.Fatalf("got %d actions on flapping targets, expect 4", len(actions))
+	}
+	for _, a := range actions {
+		if !a.Flapping {
+			t.Errorf("action %s %s on flapping target is not flagged", a.VolumeID, a.Type)
+		}
+	}
+}
+
+func TestHealerPlanDroppedRelogin(t *testing.T) {
+	out, err := os.ReadFile("testdata/session_p3.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := parseSessions(string(out))
+	sessions[0].SCSIDevices[1].State = "offline" // sdc
+
+	volumes := []*Volume{
+		{ID: "vol1", Targets: []*Target{{Portal: "192.168.206.50", Name: "iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr1", Lun: 1, Iface: "default"}}},
+		{ID: "vol2", Targets: []*Target{{Portal: "[fe80::1]", Name: "iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr2", Lun: 0}}},
+	}
+	opts := &HealerOptions{FailedTimeout: time.Minute, Backoff: time.Minute, MaxTargets: 1}
+	h, err := (&ISCSIUtil{}).NewHealer(volumes, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The relogin of vol2 is due in the second round but dropped by
+	// MaxTargets, so it is planned once vol1 is in backoff.
+	now := time.Now()
+	for i, round := range []struct {
+		at     time.Duration
+		expect HealActionType
+	}{
+		{0, HealReinstate},
+		{2 * time.Minute, HealReinstate},
+		{2*time.Minute + 30*time.Second, HealRelogin},
+	} {
+		actions := h.plan(context.Background(), sessions, nil, now.Add(round.at))
+		if len(actions) != 1 || actions[0].Type != round.expect {
+			for _, a := range actions {
+				t.Logf("%s %s device=%s", a.VolumeID, a.Type, a.Device)
+			}
+			t.Fatalf("round %d got %d actions, expect one %s", i, len(actions), round.expect)
+		}
+	}
+}
+
+// fakeIscsiadm puts an iscsiadm on PATH that prints out and exits with code.
+func fakeIscsiadm(t *testing.T, out string, code int) {
+	dir := t.TempDir()
+	script := fmt.Sprintf("#!/bin/sh\necho '%s'\nexit %d\n", out, code)
+	if err := os.WriteFile(filepath.Join(dir, "iscsiadm"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+}
+
+func TestHealSkipsFailedSnapshot(t *testing.T) {
+	volumes := []*Volume{{ID: "vol1", Targets: []*Target{
+		{Portal: "192.168.206.50", Name: "iqn.2004-08.com.qsan:dev3.ctr1"},
+	}}}
+	h, err := (&ISCSIUtil{Opts: ISCSIOptions{SessionCacheTTL: time.Minute}}).NewHealer(volumes, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fakeIscsiadm(t, "iscsiadm: initiator reported error", 1)
+	if actions := h.Heal(context.Background()); len(actions) != 0 {
+		t.Fatalf("failed snapshot should skip the round, got %d actions", len(actions))
+	}
+	if _, err := h.iscsi.freshSessions(context.Background()); err == nil {
+		t.Fatalf("expect error of failed snapshot")
+	}
+	if h.iscsi.cache.sessions != nil {
+		t.Fatalf("failed snapshot should not be cached")
+	}
+
+	fakeIscsiadm(t, "iscsiadm: No active sessions.", 21)
+	sessions, err := h.iscsi.freshSessions(context.Background())
+	if err != nil || len(sessions) != 0 {
+		t.Fatalf("no active sessions should be an empty snapshot: %v, %v", sessions, err)
+	}
+}
@@ -0,0 +1,204 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+type Iface struct {
+	Name          string `json:"name" yaml:"name"`                                       // iface.iscsi_ifacename
+	Transport     string `json:"transport" yaml:"transport"`                             // iface.transport_name, default is tcp
+	HWAddress     string `json:"hwAddress,omitempty" yaml:"hwAddress,omitempty"`         // iface.hwaddress
+	IPAddress     string `json:"ipAddress,omitempty" yaml:"ipAddress,omitempty"`         // iface.ipaddress
+	NetIfaceName  string `json:"netIfaceName,omitempty" yaml:"netIfaceName,omitempty"`   // iface.net_ifacename
+	InitiatorName string `json:"initiatorName,omitempty" yaml:"initiatorName,omitempty"` // iface.initiatorname
+}
+
+const (
+	defaultIfaceTransport = "tcp"
+	ifacePrefix           = "goiscsi-"
+)
+
+func (iscsi *ISCSIUtil) ListIfaces() ([]*Iface, error) {
+	return iscsi.listIfaces(context.Background())
+}
+
+func (iscsi *ISCSIUtil) listIfaces(ctx context.Context) ([]*Iface, error) {
+	out, err := iscsi.execCmd(ctx, "iscsiadm", "-m", "iface")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list iface, err: %v", err)
+	}
+
+	return parseIfaces(out), nil
+}
+
+func (iscsi *ISCSIUtil) GetIface(name string) (*Iface, error) {
+	ctx := context.Background()
+	out, err := iscsi.execCmd(ctx, "iscsiadm", "-m", "iface", "-I", name)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get iface %s, err: %v", name, err)
+	}
+
+	iface := &Iface{}
+	for _, line := range strings.Split(out, "\n") {
+		key, value := fieldKeyValue(line, "=")
+		switch key {
+		case "iface.iscsi_ifacename":
+			iface.Name = value
+		case "iface.transport_name":
+			iface.Transport = value
+		case "iface.hwaddress":
+			iface.HWAddress = value
+		case "iface.ipaddress":
+			iface.IPAddress = value
+		case "iface.net_ifacename":
+			iface.NetIfaceName = value
+		case "iface.initiatorname":
+			iface.InitiatorName = value
+		}
+	}
+
+	return iface, nil
+}
+
+func (iscsi *ISCSIUtil) CreateIface(iface *Iface) error {
+	return iscsi.createIface(context.Background(), iface)
+}
+
+func (iscsi *ISCSIUtil) createIface(ctx context.Context, iface *Iface) error {
+	if _, err := iscsi.execCmd(ctx, "iscsiadm", "-m", "iface", "-I", iface.Name, "-o", "new"); err != nil {
+		return fmt.Errorf("Failed to create iface %s, err: %v", iface.Name, err)
+	}
+
+	if err := iscsi.updateIface(ctx, iface); err != nil {
+		iscsi.deleteIface(ctx, iface.Name)
+		return err
+	}
+
+	return nil
+}
+
+// UpdateIface writes the non-empty fields of iface to its iface record.
+func (iscsi *ISCSIUtil) UpdateIface(iface *Iface) error {
+	return iscsi.updateIface(context.Background(), iface)
+}
+
+func (iscsi *ISCSIUtil) updateIface(ctx context.Context, iface *Iface) error {
+	transport := iface.Transport
+	if transport == "" {
+		transport = defaultIfaceTransport
+	}
+
+	settings := [][2]string{
+		{"iface.transport_name", transport},
+		{"iface.hwaddress", iface.HWAddress},
+		{"iface.ipaddress", iface.IPAddress},
+		{"iface.net_ifacename", iface.NetIfaceName},
+		{"iface.initiatorname", iface.InitiatorName},
+	}
+	for _, setting := range settings {
+		if setting[1] == "" {
+			continue
+		}
+
+		args := []string{"-m", "iface", "-I", iface.Name, "-o", "update", "-n", setting[0], "-v", setting[1]}
+		if _, err := iscsi.execCmd(ctx, "iscsiadm", args...); err != nil {
+			return fmt.Errorf("Failed to update %s of iface %s, err: %v", setting[0], iface.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (iscsi *ISCSIUtil) DeleteIface(name string) error {
+	return iscsi.deleteIface(context.Background(), name)
+}
+
+func (iscsi *ISCSIUtil) deleteIface(ctx context.Context, name string) error {
+	if _, err := iscsi.execCmd(ctx, "iscsiadm", "-m", "iface", "-I", name, "-o", "delete"); err != nil {
+		return fmt.Errorf("Failed to delete iface %s, err: %v", name, err)
+	}
+
+	return nil
+}
+
+// ifaceName returns the iface record name for an iface name or hardware address.
+// An iface bound to the hardware address is created if none exists.
+func (iscsi *ISCSIUtil) ifaceName(ctx context.Context, value string) (string, error) {
+	mac, err := net.ParseMAC(value)
+	if err != nil {
+		return value, nil
+	}
+
+	// Serialize lookup and creation of the iface of the same hardware address
+	unlock := targetLocks.lock("iface," + mac.String())
+	defer unlock()
+
+	ifaces, err := iscsi.listIfaces(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		if hw, err := net.ParseMAC(iface.HWAddress); err == nil && hw.String() == mac.String() {
+			return iface.Name, nil
+		}
+	}
+
+	iface := &Iface{
+		Name:      ifacePrefix + strings.ReplaceAll(mac.String(), ":", ""),
+		Transport: defaultIfaceTransport,
+		HWAddress: mac.String(),
+	}
+	iscsi.logger().V(1).Info("Create iface", "iface", iface.Name, "hwAddress", iface.HWAddress)
+	if err := iscsi.createIface(ctx, iface); err != nil {
+		return "", err
+	}
+
+	return iface.Name, nil
+}
+
+// sessionIfaceMatches reports whether sess uses iface, given as an iface name or
+// hardware address. An empty iface matches any session.
+func sessionIfaceMatches(sess *Session, iface string) bool {
+	if iface == "" {
+		return true
+	}
+
+	if mac, err := net.ParseMAC(iface); err == nil {
+		hw, err := net.ParseMAC(sess.IfaceHWAddress)
+		return err == nil && hw.String() == mac.String()
+	}
+
+	return sess.Iface == iface
+}
+
+// parseIfaces parses `iscsiadm -m iface` output, one iface per line as
+// "name transport,hwaddress,ipaddress,net_ifacename,initiatorname".
+func parseIfaces(out string) []*Iface {
+	var ifaces []*Iface
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+
+		values := strings.Split(fields[1], ",")
+		for len(values) < 5 {
+			values = append(values, "")
+		}
+		ifaces = append(ifaces, &Iface{
+			Name:          fields[0],
+			Transport:     replaceEmpty(values[0]),
+			HWAddress:     replaceEmpty(values[1]),
+			IPAddress:     replaceEmpty(values[2]),
+			NetIfaceName:  replaceEmpty(values[3]),
+			InitiatorName: replaceEmpty(values[4]),
+		})
+	}
+
+	return ifaces
+}
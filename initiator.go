@@ -0,0 +1,141 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/QsanJohnson/goiscsi/iscsiname"
+)
+
+const (
+	defaultInitiatorNameFile = "/etc/iscsi/initiatorname.iscsi"
+	defaultInitiatorPrefix   = "iqn.2016-04.com.open-iscsi"
+	initiatorNameKey         = "InitiatorName"
+)
+
+// GetInitiatorName returns the initiator IQN configured in the initiator name file.
+func (iscsi *ISCSIUtil) GetInitiatorName() (string, error) {
+	file, err := os.Open(iscsi.initiatorNameFile())
+	if err != nil {
+		return "", fmt.Errorf("Failed to open initiator name file, err: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value := fieldKeyValue(line, "=")
+		if key == initiatorNameKey && len(value) > 0 {
+			return value, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("Failed to read initiator name file, err: %v", err)
+	}
+
+	return "", fmt.Errorf("InitiatorName not found in %s", iscsi.initiatorNameFile())
+}
+
+// SetInitiatorName writes the initiator IQN to the initiator name file, keeping
+// comments and other settings such as InitiatorAlias. iscsid only reads the file
+// at startup, so restartIscsid should be set when sessions must use the new name.
+func (iscsi *ISCSIUtil) SetInitiatorName(name string, restartIscsid bool) error {
+	if err := validateInitiatorName(name); err != nil {
+		return err
+	}
+
+	path := iscsi.initiatorNameFile()
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to read initiator name file, err: %v", err)
+	}
+
+	// Other lines are copied as is, with their line endings. Later InitiatorName
+	// lines are dropped since iscsid only uses the first one.
+	var sb strings.Builder
+	replaced := false
+	for _, line := range strings.SplitAfter(string(content), "\n") {
+		key, _ := fieldKeyValue(line, "=")
+		if !strings.HasPrefix(strings.TrimSpace(line), "#") && key == initiatorNameKey {
+			if replaced {
+				continue
+			}
+			eol := line[len(strings.TrimRight(line, "\r\n")):]
+			if eol == "" {
+				eol = "\n"
+			}
+			line = initiatorNameKey + "=" + name + eol
+			replaced = true
+		}
+		sb.WriteString(line)
+	}
+	if !replaced {
+		if sb.Len() > 0 && !strings.HasSuffix(sb.String(), "\n") {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(initiatorNameKey + "=" + name + "\n")
+	}
+
+	if err := writeFileAtomic(path, []byte(sb.String()), 0644); err != nil {
+		return fmt.Errorf("Failed to write initiator name file, err: %v", err)
+	}
+	iscsi.logger().V(1).Info("Set initiator name", "file", path, "name", name)
+
+	if restartIscsid {
+		return iscsi.restartIscsiDaemon(context.Background())
+	}
+
+	return nil
+}
+
+// GenerateInitiatorName returns a new random IQN under the given naming authority
+// prefix, e.g. "iqn.2004-08.com.qsan". The open-iscsi prefix is used if prefix is empty.
+func GenerateInitiatorName(prefix string) (string, error) {
+	if prefix == "" {
+		prefix = defaultInitiatorPrefix
+	}
+
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("Failed to generate initiator name, err: %v", err)
+	}
+
+	name := prefix + ":" + hex.EncodeToString(buf)
+	if err := validateInitiatorName(name); err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+func (iscsi *ISCSIUtil) initiatorNameFile() string {
+	if iscsi.Opts.InitiatorNameFile != "" {
+		return iscsi.Opts.InitiatorNameFile
+	}
+	return defaultInitiatorNameFile
+}
+
+func validateInitiatorName(name string) error {
+	if err := iscsiname.Validate(name); err != nil {
+		return fmt.Errorf("Invalid initiator name, err: %v", err)
+	}
+	return nil
+}
+
+func (iscsi *ISCSIUtil) restartIscsiDaemon(ctx context.Context) error {
+	if _, err := iscsi.execCmd(ctx, "systemctl", "restart", "iscsid"); err != nil {
+		return fmt.Errorf("Failed to restart iscsid, err: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInitiatorName(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "initiatorname.iscsi")
+	content := "## DO NOT EDIT OR REMOVE THIS FILE!\n\nInitiatorName=iqn.1993-08.org.debian:01:old\r\n\n  InitiatorAlias = node1\n#InitiatorName=iqn.1993-08.org.debian:01:commented\nInitiatorName=iqn.1993-08.org.debian:01:dup\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	util := &ISCSIUtil{Opts: ISCSIOptions{InitiatorNameFile: path}}
+	name, err := util.GetInitiatorName()
+	if err != nil || name != "iqn.1993-08.org.debian:01:old" {
+		t.Fatalf("GetInitiatorName got %q, err: %v", name, err)
+	}
+
+	newName, err := GenerateInitiatorName("iqn.2004-08.com.qsan")
+	if err != nil {
+		t.Fatalf("GenerateInitiatorName failed: %v", err)
+	}
+	if err := util.SetInitiatorName(newName, false); err != nil {
+		t.Fatalf("SetInitiatorName failed: %v", err)
+	}
+
+	if name, _ = util.GetInitiatorName(); name != newName {
+		t.Fatalf("GetInitiatorName got %q, expect %q", name, newName)
+	}
+	data, _ := os.ReadFile(path)
+	expected := strings.Replace(content, "iqn.1993-08.org.debian:01:old", newName, 1)
+	expected = strings.Replace(expected, "InitiatorName=iqn.1993-08.org.debian:01:dup\n", "", 1)
+	if string(data) != expected {
+		t.Fatalf("SetInitiatorName got\n%q\nexpect\n%q", data, expected)
+	}
+
+	// Files without InitiatorName get it appended
+	if err := os.WriteFile(path, []byte("# no name"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := util.SetInitiatorName(newName, false); err != nil {
+		t.Fatalf("SetInitiatorName failed: %v", err)
+	}
+	if data, _ = os.ReadFile(path); string(data) != "# no name\nInitiatorName="+newName+"\n" {
+		t.Fatalf("SetInitiatorName got %q", data)
+	}
+
+	if err := util.SetInitiatorName("bad name", false); err == nil {
+		t.Fatalf("SetInitiatorName should reject invalid name")
+	}
+}
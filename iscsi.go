@@ -8,202 +8,456 @@ import (
 	"strings"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/klog/v2"
 )
 
 type ISCSIUtil struct {
 	Opts ISCSIOptions
+
+	cache sessionCache
 }
 
 type ISCSIOptions struct {
-	Timeout   time.Duration // Millisecond
-	ForceMPIO bool
+	Timeout           time.Duration // Millisecond
+	ForceMPIO         bool
+	InitiatorNameFile string               // Default is /etc/iscsi/initiatorname.iscsi
+	Resolver          Resolver             // Resolves portal host names, default is net.DefaultResolver
+	Iface             string               // Default iface name or hardware address of targets without Iface
+	NrSessions        int                  // Number of sessions per target, default is 1
+	NodeConfig        *NodeConfig          // Node settings applied to new nodes at login
+	LockDir           string               // Directory of per-target lock files shared with other processes, disabled if empty
+	Workers           int                  // Number of targets processed concurrently, default is 4
+	SessionCacheTTL   time.Duration        // How long a session snapshot is reused, disabled if zero
+	Logger            logr.Logger          // Structured logger, default is klog
+	Observer          Observer             // Receives the outcome of operations, e.g. metrics.Metrics
+	TracerProvider    trace.TracerProvider // Provider of operation spans, default is the global provider
+}
+
+// Observer is notified of the duration and error of each Login, Logout, GetDisk
+// and rescan call, op being one of the Op constants.
+type Observer interface {
+	ObserveOperation(op string, d time.Duration, err error)
 }
 
+// Operation names passed to Observer.
+const (
+	OpLogin   = "login"
+	OpLogout  = "logout"
+	OpGetDisk = "getdisk"
+	OpRescan  = "rescan"
+)
+
+// Chap is the CHAP setting of a target. Passwd is never encoded, so that
+// targets in results, events and states do not leak it.
 type Chap struct {
-	User, Passwd string
+	User   string `json:"user" yaml:"user"`
+	Passwd string `json:"-" yaml:"-"`
 }
 
 type Target struct {
-	Portal string
-	Name   string
-	Lun    uint64
-	Chap   *Chap
+	Portal  string `json:"portal" yaml:"portal"`
+	Name    string `json:"name" yaml:"name"`
+	Lun     uint64 `json:"lun" yaml:"lun"`
+	Chap    *Chap  `json:"chap,omitempty" yaml:"chap,omitempty"`
+	Iface   string `json:"iface,omitempty" yaml:"iface,omitempty"`     // Bind sessions to an iface name or hardware address, e.g. "eth1-iface" or "00:11:22:33:44:55"
+	Startup string `json:"startup,omitempty" yaml:"startup,omitempty"` // Node startup mode, StartupManual, StartupAutomatic or StartupOnBoot, default follows iscsid.conf
+
+	portalName string // Portal as given by the caller when Portal holds its resolved address
 }
 
 type Device struct {
-	Name, Size            string
-	Type, State           string
-	Vendor, Model, Serial string
+	Name   string `json:"name" yaml:"name"`
+	Size   string `json:"size" yaml:"size"`
+	Type   string `json:"type" yaml:"type"`
+	State  string `json:"state" yaml:"state"`
+	Vendor string `json:"vendor" yaml:"vendor"`
+	Model  string `json:"model" yaml:"model"`
+	Serial string `json:"serial" yaml:"serial"`
 }
 
 type Disk struct {
-	Valid                 bool
-	Status                string
-	Name, Size            string
-	Vendor, Model, Serial string
-	MpathCnt, DiskCnt     int
-	Devices               map[string]*Device
+	Valid    bool               `json:"valid" yaml:"valid"`
+	Status   string             `json:"status" yaml:"status"`
+	Name     string             `json:"name" yaml:"name"`
+	Size     string             `json:"size" yaml:"size"`
+	Vendor   string             `json:"vendor" yaml:"vendor"`
+	Model    string             `json:"model" yaml:"model"`
+	Serial   string             `json:"serial" yaml:"serial"`
+	MpathCnt int                `json:"mpathCnt" yaml:"mpathCnt"`
+	DiskCnt  int                `json:"diskCnt" yaml:"diskCnt"`
+	Devices  map[string]*Device `json:"devices" yaml:"devices"`
 }
 
 type Session struct {
-	Portal      string
-	Target      string
-	State       string
-	SCSIDevices []*SCSIDevice
+	SID            int           `json:"sid" yaml:"sid"`
+	Portal         string        `json:"portal" yaml:"portal"`
+	Target         string        `json:"target" yaml:"target"`
+	State          string        `json:"state" yaml:"state"`
+	Iface          string        `json:"iface,omitempty" yaml:"iface,omitempty"`
+	IfaceHWAddress string        `json:"ifaceHWAddress,omitempty" yaml:"ifaceHWAddress,omitempty"`
+	Host           int           `json:"host" yaml:"host"` // SCSI host number
+	SCSIDevices    []*SCSIDevice `json:"scsiDevices,omitempty" yaml:"scsiDevices,omitempty"`
+}
+
+// TargetResult is the outcome of an operation on one target.
+type TargetResult struct {
+	Target   *Target
+	Err      error
+	Duration time.Duration
 }
 
 type SCSIDevice struct {
-	Lun   uint64
-	Name  string
-	State string
+	Lun   uint64 `json:"lun" yaml:"lun"`
+	Name  string `json:"name" yaml:"name"`
+	State string `json:"state" yaml:"state"`
 }
 
 const (
 	defaultPort        = "3260"
+	byPathDir          = "/dev/disk/by-path/"
 	deviceRetryCnt     = 30
 	deviceRetryTimeout = 1000 // Millisecond
 	dmRetryCnt         = 30
 	dmRetryTimeout     = 100 // Millisecond
+	defaultWorkers     = 4
 )
 
+var defaultLogger = klog.NewKlogr().WithName("goiscsi")
+
 func (iscsi *ISCSIUtil) Login(targets []*Target) error {
-	success := false
-	needRescan := false
-	var err error
-	sessions := getSessions()
-	for _, target := range targets {
-		if targetSessionExists(sessions, target) {
-			glog.V(1).Infof("Target session is already exist: %+v\n", target)
-			needRescan = true
-			success = true
-			continue
-		}
+	_, err := iscsi.LoginContext(context.Background(), targets)
+	return err
+}
 
-		baseArgs := []string{"-m", "node", "-T", target.Name, "-p", target.Portal}
-		if _, err = execCmd("iscsiadm", append(baseArgs, []string{"-o", "new"}...)...); err != nil {
-			glog.Errorf("Failed to new node, err: %v", err)
+// LoginContext logs in targets concurrently, at most ISCSIOptions.Workers at a
+// time, and returns the result of each target in the order of targets. ctx bounds
+// the whole operation. As Login, it returns nil as long as one target is logged in.
+func (iscsi *ISCSIUtil) LoginContext(ctx context.Context, targets []*Target) (_ []*TargetResult, err error) {
+	defer iscsi.observe(OpLogin, time.Now(), &err)
+	ctx, span := iscsi.startSpan(ctx, "Login", targetsAttrs(targets)...)
+	defer endSpan(span, &err)
+	if err := validateTargets(targets); err != nil {
+		return nil, err
+	}
+	for _, target := range targets {
+		if _, err := iscsi.targetNodeConfig(target).updateArgs(); err != nil {
+			return nil, err
 		}
+	}
 
-		if target.Chap != nil {
-			if _, err = execCmd("iscsiadm", append(baseArgs, []string{"-o", "update",
-				"-n", "node.session.auth.authmethod", "-v", "CHAP",
-				"-n", "node.session.auth.username", "-v", target.Chap.User,
-				"-n", "node.session.auth.password", "-v", target.Chap.Passwd}...)...); err != nil {
-
-				glog.Errorf("Failed to set CHAP config, err: %v", err)
-			}
+	sessions := iscsi.sessions(ctx, false)
+	resolved := iscsi.resolveTargets(ctx, sessions, targets)
+	results := make([]*TargetResult, len(targets))
+	exists := make([]bool, len(targets))
+	forEach(ctx, len(resolved), iscsi.workers(), func(ctx context.Context, i int) {
+		start := time.Now()
+		var err error
+		if err = ctx.Err(); err == nil {
+			exists[i], err = iscsi.loginTarget(ctx, resolved[i])
 		}
+		results[i] = &TargetResult{Target: targets[i], Err: err, Duration: time.Since(start)}
+	})
 
-		ctx := context.Background()
-		var cancel context.CancelFunc
-		if iscsi.Opts.Timeout > 0 {
-			ctx, cancel = context.WithTimeout(context.Background(), iscsi.Opts.Timeout*time.Millisecond)
-			defer cancel()
+	success := false
+	needRescan := false
+	for i, result := range results {
+		if exists[i] {
+			needRescan = true
 		}
-
-		if _, err = execCmdContext(ctx, "iscsiadm", append(baseArgs, []string{"-l"}...)...); err != nil {
-			glog.Errorf("Failed to login, err: %v", err)
-		} else {
+		if result.Err == nil {
 			success = true
+		} else {
+			err = result.Err
 		}
 	}
 
 	if needRescan {
-		if err = rescanSession(nil); err != nil {
-			glog.Errorf("rescanSession err: %v", err)
+		if err = iscsi.rescanSession(ctx, nil); err != nil {
+			iscsi.logger().Error(err, "Failed to rescan sessions")
 		}
+		iscsi.InvalidateSessionCache()
 	}
+	iscsi.logger().V(1).Info("Login", "targetCnt", len(targets), "rescan", needRescan, "success", success)
 
 	if success {
-		return nil
+		return results, nil
 	} else {
-		return fmt.Errorf("Login failed, err: %v", err)
+		return results, fmt.Errorf("Login failed, err: %v", err)
 	}
 }
 
 func (iscsi *ISCSIUtil) Logout(targets []*Target) error {
+	return iscsi.LogoutContext(context.Background(), targets)
+}
+
+// LogoutContext is Logout with ctx bounding the logout of each target.
+func (iscsi *ISCSIUtil) LogoutContext(ctx context.Context, targets []*Target) (err error) {
+	defer iscsi.observe(OpLogout, time.Now(), &err)
+	ctx, span := iscsi.startSpan(ctx, "Logout", targetsAttrs(targets)...)
+	defer endSpan(span, &err)
+	if err := validateTargets(targets); err != nil {
+		return err
+	}
+
 	success := true
-	var err error
-	sessions := getSessions()
-	for _, target := range targets {
-		if !targetSessionExists(sessions, target) {
-			glog.Warningf("Target session not exist: %+v\n", target)
-			continue
+	sessions := iscsi.sessions(ctx, false)
+	for _, target := range iscsi.resolveTargets(ctx, sessions, targets) {
+		if err = iscsi.logoutTarget(ctx, target); err != nil {
+			success = false
 		}
+	}
 
-		ctx := context.Background()
-		var cancel context.CancelFunc
-		if iscsi.Opts.Timeout > 0 {
-			ctx, cancel = context.WithTimeout(context.Background(), iscsi.Opts.Timeout*time.Millisecond)
-			defer cancel()
+	if success {
+		return nil
+	} else {
+		return fmt.Errorf("Logout failed, err: %v", err)
+	}
+}
+
+// loginTarget logs in a resolved target unless its session already exists,
+// in which case only missing sessions and the startup mode are updated.
+// The target is locked so that concurrent logins and logouts do not race
+// on its node record.
+func (iscsi *ISCSIUtil) loginTarget(ctx context.Context, target *Target) (_ bool, err error) {
+	ctx, span := iscsi.startSpan(ctx, "loginTarget", targetAttrs(target)...)
+	defer endSpan(span, &err)
+
+	unlock, err := iscsi.lockTarget(target)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	log := iscsi.logger().WithValues(targetValues(target)...)
+	start := time.Now()
+	sessions := iscsi.lockedSessions(ctx)
+	if cnt, sess := targetSessionCount(sessions, target); cnt > 0 {
+		log.V(1).Info("Target session already exists", "sessionCnt", cnt)
+		if cnt < iscsi.nrSessions() {
+			iscsi.addSessions(ctx, sess, iscsi.nrSessions()-cnt)
+			iscsi.InvalidateSessionCache()
+		}
+		if target.Startup != "" {
+			args, _ := (&NodeConfig{Startup: target.Startup}).updateArgs()
+			if err := iscsi.updateNode(ctx, sessions, target, args); err != nil {
+				log.Error(err, "Failed to set node startup", "startup", target.Startup)
+			}
 		}
+		return true, nil
+	}
+
+	baseArgs, err := iscsi.nodeArgs(ctx, sessions, target)
+	if err != nil {
+		log.Error(err, "Failed to get iface", "iface", target.Iface)
+		return false, err
+	}
 
-		baseArgs := []string{"-m", "node", "-T", target.Name, "-p", target.Portal}
-		if _, err = execCmdContext(ctx, "iscsiadm", append(baseArgs, []string{"-u"}...)...); err != nil {
-			glog.Errorf("Failed to logout, err: %v", err)
+	if _, err = iscsi.execCmd(ctx, "iscsiadm", append(baseArgs, []string{"-o", "new"}...)...); err != nil {
+		log.Error(err, "Failed to new node")
+	}
+
+	if target.Chap != nil {
+		if _, err = iscsi.execCmd(ctx, "iscsiadm", append(baseArgs, []string{"-o", "update",
+			"-n", "node.session.auth.authmethod", "-v", "CHAP",
+			"-n", "node.session.auth.username", "-v", target.Chap.User,
+			"-n", "node.session.auth.password", "-v", target.Chap.Passwd}...)...); err != nil {
+
+			log.Error(err, "Failed to set CHAP config")
 		}
+	}
 
-		if _, err = execCmd("iscsiadm", append(baseArgs, []string{"-o", "delete"}...)...); err != nil {
-			glog.Errorf("Failed to delete node, err: %v", err)
-			success = false
+	if nodeArgs, _ := iscsi.targetNodeConfig(target).updateArgs(); len(nodeArgs) > 0 {
+		if _, err = iscsi.execCmd(ctx, "iscsiadm", append(append(baseArgs, "-o", "update"), nodeArgs...)...); err != nil {
+			log.Error(err, "Failed to set node config")
 		}
 	}
 
-	if success {
+	if nr := iscsi.nrSessions(); nr > 1 {
+		if _, err = iscsi.execCmd(ctx, "iscsiadm", append(baseArgs, []string{"-o", "update",
+			"-n", "node.session.nr_sessions", "-v", fmt.Sprint(nr)}...)...); err != nil {
+
+			log.Error(err, "Failed to set nr_sessions", "nrSessions", nr)
+		}
+	}
+
+	ctx, cancel := iscsi.withTimeout(ctx)
+	defer cancel()
+	defer iscsi.InvalidateSessionCache()
+	if _, err = iscsi.execCmdContext(ctx, "iscsiadm", append(baseArgs, []string{"-l"}...)...); err != nil {
+		log.Error(err, "Failed to login", "duration", time.Since(start))
+		return false, err
+	}
+	log.V(1).Info("Logged in", "duration", time.Since(start))
+
+	return false, nil
+}
+
+// logoutTarget logs out the sessions of a resolved target and deletes its node
+// record. The target is locked as in loginTarget.
+func (iscsi *ISCSIUtil) logoutTarget(ctx context.Context, target *Target) (err error) {
+	ctx, span := iscsi.startSpan(ctx, "logoutTarget", targetAttrs(target)...)
+	defer endSpan(span, &err)
+
+	unlock, err := iscsi.lockTarget(target)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	log := iscsi.logger().WithValues(targetValues(target)...)
+	start := time.Now()
+	sessions := iscsi.lockedSessions(ctx)
+	if !targetSessionExists(sessions, target) {
+		log.Info("Target session does not exist")
 		return nil
-	} else {
-		return fmt.Errorf("Logout failed, err: %v", err)
 	}
+
+	ctx, cancel := iscsi.withTimeout(ctx)
+	defer cancel()
+
+	baseArgs := []string{"-m", "node", "-T", target.Name, "-p", canonicalPortal(target.Portal)}
+	if iface := sessionIface(sessions, target); iface != "" {
+		baseArgs = append(baseArgs, "-I", iface)
+	}
+
+	if _, err := iscsi.execCmdContext(ctx, "iscsiadm", append(baseArgs, []string{"-u"}...)...); err != nil {
+		log.Error(err, "Failed to logout")
+	}
+	iscsi.InvalidateSessionCache()
+
+	if _, err := iscsi.execCmd(ctx, "iscsiadm", append(baseArgs, []string{"-o", "delete"}...)...); err != nil {
+		log.Error(err, "Failed to delete node")
+		return err
+	}
+	log.V(1).Info("Logged out", "duration", time.Since(start))
+
+	return nil
+}
+
+// withTimeout applies ISCSIOptions.Timeout to ctx.
+func (iscsi *ISCSIUtil) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if iscsi.Opts.Timeout > 0 {
+		return context.WithTimeout(ctx, iscsi.Opts.Timeout*time.Millisecond)
+	}
+	return context.WithCancel(ctx)
 }
 
+// GetSession returns a copy of the session snapshot, which may come from the
+// session cache.
 func (iscsi *ISCSIUtil) GetSession() []*Session {
-	return getSessions()
+	var sessions []*Session
+	for _, sess := range iscsi.sessions(context.Background(), false) {
+		s := *sess
+		s.SCSIDevices = nil
+		for _, scsiDev := range sess.SCSIDevices {
+			d := *scsiDev
+			s.SCSIDevices = append(s.SCSIDevices, &d)
+		}
+		sessions = append(sessions, &s)
+	}
+
+	return sessions
 }
 
 func (iscsi *ISCSIUtil) RescanAllSessions() error {
-	return rescanSession(nil)
+	return iscsi.RescanSessionByTargetContext(context.Background(), nil)
 }
 
 func (iscsi *ISCSIUtil) RescanSessionByTarget(targets []*Target) error {
-	return rescanSession(targets)
+	return iscsi.RescanSessionByTargetContext(context.Background(), targets)
+}
+
+// RescanSessionByTargetContext is RescanSessionByTarget with the rescan traced
+// in ctx. All sessions are rescanned if targets is nil.
+func (iscsi *ISCSIUtil) RescanSessionByTargetContext(ctx context.Context, targets []*Target) (err error) {
+	defer iscsi.observe(OpRescan, time.Now(), &err)
+	ctx, span := iscsi.startSpan(ctx, "Rescan", targetsAttrs(targets)...)
+	defer endSpan(span, &err)
+	defer iscsi.InvalidateSessionCache()
+	return iscsi.rescanSession(ctx, targets)
 }
 
 func (iscsi *ISCSIUtil) GetDisk(targets []*Target) (*Disk, error) {
-	sessions := getSessions()
-	glog.V(2).Infof("[GetDisk] TargetCnt(%d) ForceMPIO(%v)", len(targets), iscsi.Opts.ForceMPIO)
+	return iscsi.GetDiskContext(context.Background(), targets)
+}
+
+// GetDiskContext is GetDisk with devices of targets discovered concurrently.
+// Waiting for device paths and the multipath device shares one deadline, which
+// is the earlier of the ctx deadline and the default device wait time.
+func (iscsi *ISCSIUtil) GetDiskContext(ctx context.Context, targets []*Target) (_ *Disk, err error) {
+	defer iscsi.observe(OpGetDisk, time.Now(), &err)
+	ctx, span := iscsi.startSpan(ctx, "GetDisk", targetsAttrs(targets)...)
+	defer endSpan(span, &err)
+	if err := validateTargets(targets); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, (deviceRetryCnt*deviceRetryTimeout+dmRetryCnt*dmRetryTimeout)*time.Millisecond)
+	defer cancel()
+
+	sessions := iscsi.sessions(ctx, false)
+	targets = iscsi.resolveTargets(ctx, sessions, targets)
+	pathCnt := len(targets) * iscsi.nrSessions()
+	log := iscsi.logger().WithValues("targetCnt", len(targets), "pathCnt", pathCnt)
+	log.V(2).Info("Get disk", "forceMPIO", iscsi.Opts.ForceMPIO)
+	start := time.Now()
 
 	var devMap map[string]*Device
-	var diskCnt, mpathCnt int
 	// Wait dm device path ready
 	for retries := 1; retries <= dmRetryCnt; retries++ {
-		diskCnt, mpathCnt = 0, 0
-		devMap, _ = getDevices(sessions, targets)
-		for _, dev := range devMap {
-			if dev.Type == "disk" {
-				diskCnt++
-			} else if dev.Type == "mpath" {
-				mpathCnt++
-			}
+		retryCtx, retrySpan := iscsi.startSpan(ctx, "GetDisk.retry", attribute.Int("retry", retries))
+		if retries > 1 {
+			sessions = iscsi.sessions(retryCtx, true)
+		}
+		devMap, _ = iscsi.getDevices(retryCtx, sessions, targets, iscsi.workers())
+		ready := iscsi.diskReady(devMap, pathCnt)
+		retrySpan.SetAttributes(attribute.Int("deviceCnt", len(devMap)), attribute.Bool("ready", ready))
+		retrySpan.End()
+		if ready {
+			break
 		}
 
-		if iscsi.Opts.ForceMPIO && len(targets) > 1 {
-			if mpathCnt == 0 && diskCnt > 0 {
-				glog.Warningf("[GetDisk] MPIO, sleep %d msec then try again, retries=%d\n", dmRetryTimeout, retries)
-				time.Sleep(time.Millisecond * dmRetryTimeout)
-			} else {
-				break
-			}
-		} else {
-			if diskCnt == 0 {
-				glog.Warningf("[GetDisk] sleep %d msec then try again, retries=%d\n", dmRetryTimeout, retries)
-				time.Sleep(time.Millisecond * dmRetryTimeout)
-			} else {
-				break
-			}
+		log.V(3).Info("Disk not ready, try again", "deviceCnt", len(devMap), "retries", retries, "delay", time.Millisecond*dmRetryTimeout)
+		if sleepContext(ctx, time.Millisecond*dmRetryTimeout) != nil {
+			break
 		}
 	}
 
+	disk := iscsi.newDisk(devMap, pathCnt)
+	log.V(1).Info("Got disk", "device", disk.Name, "status", disk.Status, "duration", time.Since(start))
+	return disk, nil
+}
+
+// diskReady reports whether devMap holds the disk devices and, with ForceMPIO
+// and more than one path, the multipath device.
+func (iscsi *ISCSIUtil) diskReady(devMap map[string]*Device, pathCnt int) bool {
+	diskCnt, mpathCnt := countDevices(devMap)
+	if iscsi.Opts.ForceMPIO && pathCnt > 1 {
+		return !(mpathCnt == 0 && diskCnt > 0)
+	}
+	return diskCnt > 0
+}
+
+func countDevices(devMap map[string]*Device) (int, int) {
+	var diskCnt, mpathCnt int
+	for _, dev := range devMap {
+		if dev.Type == "disk" {
+			diskCnt++
+		} else if dev.Type == "mpath" {
+			mpathCnt++
+		}
+	}
+
+	return diskCnt, mpathCnt
+}
+
+// newDisk collects the device information of devMap to a Disk expecting pathCnt paths.
+func (iscsi *ISCSIUtil) newDisk(devMap map[string]*Device, pathCnt int) *Disk {
+	diskCnt, mpathCnt := countDevices(devMap)
+
 	// Collect all device information to Disk structure
 	var vendor, model, serial string
 	var diskRunningNum int
@@ -264,20 +518,55 @@ func (iscsi *ISCSIUtil) GetDisk(targets []*Target) (*Disk, error) {
 		disk.Status = "none"
 	case diskMatch == false:
 		disk.Status = "mismatch"
-	case disk.Valid && diskRunningNum == len(targets):
+	case disk.Valid && diskRunningNum >= pathCnt:
 		disk.Status = "online"
 	case disk.Valid && diskRunningNum == 0:
 		disk.Status = "offline"
-	case disk.Valid && diskRunningNum < len(targets):
+	case disk.Valid && diskRunningNum < pathCnt:
 		disk.Status = "degrade"
 	default:
 		disk.Status = "unknown"
 	}
 
-	return disk, nil
+	return disk
+}
+
+func (iscsi *ISCSIUtil) workers() int {
+	if iscsi.Opts.Workers > 0 {
+		return iscsi.Opts.Workers
+	}
+	return defaultWorkers
+}
+
+func (iscsi *ISCSIUtil) nrSessions() int {
+	if iscsi.Opts.NrSessions > 1 {
+		return iscsi.Opts.NrSessions
+	}
+	return 1
+}
+
+// logger returns ISCSIOptions.Logger, or the klog logger if it is not set.
+func (iscsi *ISCSIUtil) logger() logr.Logger {
+	if iscsi.Opts.Logger.GetSink() == nil {
+		return defaultLogger
+	}
+	return iscsi.Opts.Logger
+}
+
+// observe reports the outcome of operation op started at start to ISCSIOptions.Observer.
+func (iscsi *ISCSIUtil) observe(op string, start time.Time, err *error) {
+	if iscsi.Opts.Observer != nil {
+		iscsi.Opts.Observer.ObserveOperation(op, time.Since(start), *err)
+	}
+}
+
+// targetValues returns the key/value pairs identifying target in log entries.
+func targetValues(target *Target) []interface{} {
+	return []interface{}{"target", target.Name, "portal", target.Portal, "lun", target.Lun}
 }
 
 func (iscsi *ISCSIUtil) RemoveDisk(devPath string) error {
+	defer iscsi.InvalidateSessionCache()
 	if strings.HasPrefix(devPath, "/dev/") {
 		devName := devPath[5:]
 		devFile := fmt.Sprintf("/sys/block/%s/device/state", devName)
@@ -289,6 +578,7 @@ func (iscsi *ISCSIUtil) RemoveDisk(devPath string) error {
 		if err := writeDeviceFile(devFile, "1"); err != nil {
 			return err
 		}
+		iscsi.logger().V(1).Info("Removed disk", "device", devName)
 	} else {
 		return fmt.Errorf("[RemoveDisk] invalid dev path: %s\n", devPath)
 	}
@@ -297,8 +587,9 @@ func (iscsi *ISCSIUtil) RemoveDisk(devPath string) error {
 }
 
 func (iscsi *ISCSIUtil) IsSessionExist(targets []*Target) bool {
-	sessions := getSessions()
-	for _, target := range targets {
+	ctx := context.Background()
+	sessions := iscsi.sessions(ctx, false)
+	for _, target := range iscsi.resolveTargets(ctx, sessions, targets) {
 		if targetSessionExists(sessions, target) {
 			return true
 		}
@@ -308,5 +599,6 @@ func (iscsi *ISCSIUtil) IsSessionExist(targets []*Target) bool {
 }
 
 func (iscsi *ISCSIUtil) HasAnotherUsedDisk(targets []*Target) (bool, error) {
-	return hasMntDevices(targets)
+	ctx := context.Background()
+	return iscsi.hasMntDevices(ctx, iscsi.resolveTargets(ctx, nil, targets))
 }
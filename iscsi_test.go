@@ -1,15 +1,14 @@
 package goiscsi
 
 import (
-	"bufio"
-	"errors"
+	"context"
 	"flag"
 	"fmt"
-	"io"
 	"os"
 	"strconv"
-	"strings"
 	"testing"
+
+	"k8s.io/klog/v2"
 )
 
 var iscsi *ISCSIUtil
@@ -17,6 +16,7 @@ var tgts []*Target
 
 func TestMain(m *testing.M) {
 	fmt.Println("------------Start of TestMain--------------")
+	klog.InitFlags(nil)
 	flag.Parse()
 
 	logLevelStr := os.Getenv("GOISCSI_LOG_LEVEL")
@@ -34,6 +34,9 @@ func TestMain(m *testing.M) {
 	// 	{Portal: "192.168.206.51:3260", Name: "iqn.2004-08.com.qsan:xf2026-000d42f58:dev2.ctr2", Lun: 0, Chap: &Chap{User: "johnson", Passwd: "111122223333"}},
 	// }
 	tgts = getTestTarget()
+	if tgts == nil {
+		fmt.Println("test.conf not found, skip the integration tests")
+	}
 	fmt.Printf("Test tgt cnt=%d\n", len(tgts))
 	for _, t := range tgts {
 		fmt.Printf("  %+v\n", t)
@@ -45,6 +48,7 @@ func TestMain(m *testing.M) {
 }
 
 func TestLogin(t *testing.T) {
+	skipWithoutTarget(t)
 	err := iscsi.Login(tgts)
 	if err != nil {
 		t.Fatalf("TestLogin failed: %v", err)
@@ -52,6 +56,7 @@ func TestLogin(t *testing.T) {
 }
 
 func TestGetSession(t *testing.T) {
+	skipWithoutTarget(t)
 	sessions := iscsi.GetSession()
 	for _, sess := range sessions {
 		fmt.Printf("%+v\n", sess)
@@ -62,6 +67,7 @@ func TestGetSession(t *testing.T) {
 }
 
 func TestGetDisk(t *testing.T) {
+	skipWithoutTarget(t)
 	disk, err := iscsi.GetDisk(tgts)
 	if err != nil {
 		t.Fatalf("TestGetDisk failed: %v", err)
@@ -82,10 +88,12 @@ func TestGetDisk(t *testing.T) {
 }
 
 func TestHasAnotherUsedDisk(t *testing.T) {
+	skipWithoutTarget(t)
 	iscsi.HasAnotherUsedDisk(tgts)
 }
 
 func TestRescanSession(t *testing.T) {
+	skipWithoutTarget(t)
 	if err := iscsi.RescanAllSessions(); err != nil {
 		t.Fatalf("RescanAllSessions failed: %v", err)
 	} else {
@@ -100,89 +108,57 @@ func TestRescanSession(t *testing.T) {
 }
 
 func TestLogout(t *testing.T) {
+	skipWithoutTarget(t)
 	err := iscsi.Logout(tgts)
 	if err != nil {
 		t.Fatalf("TestLogout failed: %v", err)
 	}
 }
 
-func getTestTarget() []*Target {
-	prop, err := readTestConf("test.conf")
-	if err != nil {
-		panic("The system cannot find the file: test.conf")
+func TestAttachDetachVolumes(t *testing.T) {
+	skipWithoutTarget(t)
+	vols := []*Volume{{ID: "test-vol", Targets: tgts}}
+	results := iscsi.AttachVolumes(context.Background(), vols)
+	if results[0].Err != nil {
+		t.Fatalf("AttachVolumes failed: %v", results[0].Err)
 	}
-
-	if (len(prop["PORTALS"]) == 0) || (len(prop["NODES"]) == 0) || (len(prop["LUNS"]) == 0) {
-		panic("test.conf format error! The value of PORTAL, NODE or LUN is invalid.")
+	fmt.Printf("Attach volume: %+v\n", results[0].Disk)
+	if !results[0].Disk.Valid {
+		t.Fatalf("AttachVolumes failed: disk is invalid")
 	}
 
-	portalArr := strings.Split(prop["PORTALS"], ",")
-	nodeArr := strings.Split(prop["NODES"], ",")
-	lunArr := strings.Split(prop["LUNS"], ",")
-	if (len(portalArr) != len(nodeArr)) || (len(nodeArr) != len(lunArr)) {
-		panic("test.conf format error! The number of PORTAL, NODE and LUN should be the same.")
+	results = iscsi.DetachVolumes(context.Background(), vols)
+	if results[0].Err != nil {
+		t.Fatalf("DetachVolumes failed: %v", results[0].Err)
 	}
-
-	var targets []*Target
-	var chap *Chap
-	if len(prop["CHAP_USER"]) > 0 && len(prop["CHAP_PASSWD"]) > 0 {
-		chap = &Chap{
-			User:   prop["CHAP_USER"],
-			Passwd: prop["CHAP_PASSWD"],
-		}
+	if iscsi.IsSessionExist(tgts) {
+		t.Fatalf("DetachVolumes failed: session still exists")
 	}
+}
 
-	for i, _ := range portalArr {
-		portal := strings.TrimSpace(portalArr[i])
-		tokens := strings.Split(portal, ":")
-		if len(tokens) == 1 {
-			portal += (":" + defaultPort)
-		}
-
-		lun, _ := strconv.ParseUint(strings.TrimSpace(lunArr[i]), 10, 32)
-		target := &Target{
-			Portal: portal,
-			Name:   strings.TrimSpace(nodeArr[i]),
-			Lun:    lun,
-			Chap:   chap,
-		}
-		targets = append(targets, target)
+// skipWithoutTarget skips integration tests, which need the iSCSI target of
+// test.conf.
+func skipWithoutTarget(t *testing.T) {
+	if tgts == nil {
+		t.Skip("test.conf not found")
 	}
-
-	return targets
 }
 
-func readTestConf(filename string) (map[string]string, error) {
-	configPropertiesMap := map[string]string{}
-	if len(filename) == 0 {
-		return nil, errors.New("Error reading conf file " + filename)
+// getTestTarget returns the targets of test.conf, or nil if it does not exist.
+func getTestTarget() []*Target {
+	if _, err := os.Stat("test.conf"); os.IsNotExist(err) {
+		return nil
 	}
-	file, err := os.Open(filename)
+
+	profile, err := LoadProfile("test.conf")
 	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	reader := bufio.NewReader(file)
-
-	for {
-		line, err := reader.ReadString('\n')
-		if equal := strings.Index(line, "="); equal >= 0 {
-			if key := strings.TrimSpace(line[:equal]); len(key) > 0 {
-				value := ""
-				if len(line) > equal {
-					value = strings.TrimSpace(line[equal+1:])
-				}
-				configPropertiesMap[key] = value
-			}
-		}
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
+		panic(fmt.Sprintf("test.conf format error! %v", err))
 	}
 
-	return configPropertiesMap, nil
+	targets := profile.Targets(DefaultProfileVolume)
+	if targets == nil {
+		panic("test.conf format error! The value of PORTALS, NODES or LUNS is missing.")
+	}
+
+	return targets
 }
@@ -3,28 +3,46 @@
 package goiscsi
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/QsanJohnson/goiscsi/iscsiname"
+	"go.opentelemetry.io/otel/attribute"
 	kexec "k8s.io/utils/exec"
 	mount "k8s.io/utils/mount"
 )
 
-func getSessions() []*Session {
-	var sessions []*Session
+func (iscsi *ISCSIUtil) getSessions(ctx context.Context) []*Session {
+	sessions, err := iscsi.listSessions(ctx)
+	if err != nil {
+		iscsi.logger().Info("Failed to get session", "err", err)
+	}
 
+	return sessions
+}
+
+// listSessions runs `iscsiadm -m session -P 3`. Unlike getSessions, a failure
+// is returned rather than taken as no session.
+func (iscsi *ISCSIUtil) listSessions(ctx context.Context) ([]*Session, error) {
 	args := []string{"-m", "session", "-P", "3"}
-	out, err := execCmd("iscsiadm", args...)
+	out, err := iscsi.execCmd(ctx, "iscsiadm", args...)
 	if err != nil {
-		glog.Warningf("Failed to get session, err: %v", err)
-		return sessions
+		if strings.Contains(err.Error(), "No active sessions") {
+			return nil, nil
+		}
+		return nil, err
 	}
 
+	return parseSessions(out), nil
+}
+
+// parseSessions parses the output of `iscsiadm -m session -P 3`.
+func parseSessions(out string) []*Session {
+	var sessions []*Session
 	var curTarget string
 	var curSession *Session
 	var scsiDev *SCSIDevice
@@ -38,12 +56,23 @@ func getSessions() []*Session {
 		case strings.HasPrefix(line, "Current Portal:"):
 			tmpSession := Session{
 				Target: curTarget,
-				Portal: strings.Split(sessionFieldValue(line), ",")[0],
+				Portal: canonicalPortal(sessionFieldValue(line)),
 			}
 			curSession = &tmpSession
 			sessions = append(sessions, curSession)
+		case strings.HasPrefix(line, "Iface Name:"):
+			curSession.Iface = sessionFieldValue(line)
+		case strings.HasPrefix(line, "Iface HWaddress:"):
+			curSession.IfaceHWAddress = sessionFieldValue(line)
+		case strings.HasPrefix(line, "SID:"):
+			curSession.SID, _ = strconv.Atoi(sessionFieldValue(line))
 		case strings.HasPrefix(line, "iSCSI Session State:"):
 			curSession.State = sessionFieldValue(line)
+		case strings.HasPrefix(line, "Host Number:"):
+			// "Host Number: 3	State: running"
+			if fields := strings.Fields(sessionFieldValue(line)); len(fields) > 0 {
+				curSession.Host, _ = strconv.Atoi(fields[0])
+			}
 		case strings.HasPrefix(line, "scsi"):
 			lun, _ := strconv.ParseUint(sessionFieldValue(line), 10, 32)
 			tmpScsiDev := SCSIDevice{Lun: lun}
@@ -58,16 +87,27 @@ func getSessions() []*Session {
 	return sessions
 }
 
-func rescanSession(targets []*Target) error {
+// addSessions adds cnt sessions to the target of sess.
+func (iscsi *ISCSIUtil) addSessions(ctx context.Context, sess *Session, cnt int) {
+	for i := 0; i < cnt; i++ {
+		args := []string{"-m", "session", "-r", fmt.Sprint(sess.SID), "-o", "new"}
+		if _, err := iscsi.execCmd(ctx, "iscsiadm", args...); err != nil {
+			iscsi.logger().Error(err, "Failed to add session", "target", sess.Target, "portal", sess.Portal, "sid", sess.SID)
+			return
+		}
+	}
+}
+
+func (iscsi *ISCSIUtil) rescanSession(ctx context.Context, targets []*Target) error {
 	if targets == nil {
 		args := []string{"-m", "session", "--rescan"}
-		if _, err := execCmd("iscsiadm", args...); err != nil {
+		if _, err := iscsi.execCmd(ctx, "iscsiadm", args...); err != nil {
 			return fmt.Errorf("Failed to rescan session, err: %v", err)
 		}
 	} else {
 		for _, target := range targets {
 			args := []string{"-m", "node", "-T", target.Name, "--rescan"}
-			if _, err := execCmd("iscsiadm", args...); err != nil {
+			if _, err := iscsi.execCmd(ctx, "iscsiadm", args...); err != nil {
 				return fmt.Errorf("Failed to rescan session of target(%s), err: %v", target.Name, err)
 			}
 		}
@@ -76,62 +116,133 @@ func rescanSession(targets []*Target) error {
 	return nil
 }
 
-func getDevices(sessions []*Session, targets []*Target) (map[string]*Device, error) {
-	var devs []*Device
+func (iscsi *ISCSIUtil) rescanSessionByID(ctx context.Context, sid int) error {
+	args := []string{"-m", "session", "-r", fmt.Sprint(sid), "--rescan"}
+	if _, err := iscsi.execCmd(ctx, "iscsiadm", args...); err != nil {
+		return fmt.Errorf("Failed to rescan session %d, err: %v", sid, err)
+	}
+
+	return nil
+}
+
+// getDevices waits for the device path of each target, up to workers targets
+// concurrently, and returns the devices keyed by kernel name.
+func (iscsi *ISCSIUtil) getDevices(ctx context.Context, sessions []*Session, targets []*Target, workers int) (map[string]*Device, error) {
+	devMaps := make([]map[string]*Device, len(targets))
+	forEach(ctx, len(targets), workers, func(ctx context.Context, i int) {
+		devMaps[i] = iscsi.getTargetDevices(ctx, sessions, targets[i])
+	})
+
 	devMap := make(map[string]*Device)
-	for _, target := range targets {
-		devicePath := strings.Join([]string{"/dev/disk/by-path/ip", target.Portal, "iscsi", target.Name, "lun", fmt.Sprint(target.Lun)}, "-")
-		glog.V(2).Infof("[getDevices] devicePath=%s \n", devicePath)
-
-		// Wait device path ready if device lun session exists
-		exists := false
-		for retries := 1; retries <= deviceRetryCnt; retries++ {
-			_, err := os.Stat(devicePath)
-			if os.IsNotExist(err) && lunSessionExists(sessions, target) {
-				glog.V(3).Infof("[getDevices] sleep %d msec then try again, retries=%d (%s)\n", deviceRetryTimeout, retries, devicePath)
-				time.Sleep(time.Millisecond * deviceRetryTimeout)
-			} else {
-				exists = true
-				break
-			}
+	for _, m := range devMaps {
+		for kname, dev := range m {
+			devMap[kname] = dev
 		}
+	}
 
-		if exists {
-			args := []string{"-rn", "-o", "NAME,KNAME,PKNAME,TYPE,STATE,SIZE,VENDOR,MODEL,WWN"}
-			out, err := execCmd("lsblk", append(args, []string{devicePath}...)...)
-			if err == nil {
-				lines := strings.Split(strings.Trim(string(out), "\n"), "\n")
-				for _, line := range lines {
-					tokens := strings.Split(line, " ")
-					glog.V(2).Infof("[getDevices] deviceInfo %+v\n", tokens)
-					dev := &Device{
-						Name:   tokens[0],
-						Type:   tokens[3],
-						State:  tokens[4],
-						Size:   tokens[5],
-						Vendor: tokens[6],
-						Model:  tokens[7],
-						Serial: tokens[8],
-					}
-					devs = append(devs, dev)
-					devMap[tokens[1]] = dev
-				}
-			} else {
-				fmt.Printf("Failed to get disk path : %v \n", err)
-			}
+	return devMap, nil
+}
+
+func (iscsi *ISCSIUtil) getTargetDevices(ctx context.Context, sessions []*Session, target *Target) map[string]*Device {
+	log := iscsi.logger().WithValues(targetValues(target)...)
+	// Wait device path ready if device lun session exists
+	for retries := 1; retries <= deviceRetryCnt; retries++ {
+		retryCtx, retrySpan := iscsi.startSpan(ctx, "waitDevice", append(targetAttrs(target), attribute.Int("retry", retries))...)
+		devMap, pending := iscsi.collectTargetDevices(retryCtx, sessions, target)
+		retrySpan.SetAttributes(attribute.Bool("ready", !pending))
+		retrySpan.End()
+		if !pending {
+			return devMap
+		}
+
+		log.V(3).Info("Device path not ready, try again", "retries", retries, "delay", time.Millisecond*deviceRetryTimeout)
+		if err := sleepContext(ctx, time.Millisecond*deviceRetryTimeout); err != nil {
+			log.Info("Stop waiting device path", "err", err)
+			break
 		}
 	}
 
-	return devMap, nil
+	return make(map[string]*Device)
 }
 
-func hasMntDevices(targets []*Target) (bool, error) {
+// collectTargetDevices returns the devices of the target LUN without waiting.
+// pending is true when the LUN session exists but its device path is not ready.
+func (iscsi *ISCSIUtil) collectTargetDevices(ctx context.Context, sessions []*Session, target *Target) (map[string]*Device, bool) {
+	var devicePaths []string
+	for _, prefix := range byPathPrefixes(target) {
+		devicePaths = append(devicePaths, byPathDir+prefix+fmt.Sprint(target.Lun))
+	}
+	iscsi.logger().V(2).Info("Collect target devices", append(targetValues(target), "devicePaths", devicePaths)...)
+
+	devicePath, found := firstExistingPath(devicePaths)
+	if !found {
+		if lunSessionExists(sessions, target) {
+			return nil, true
+		}
+		devicePath = devicePaths[0]
+	}
+
+	// Sessions beyond the first one of the same portal share the by-path
+	// link, so their devices are collected from the session information.
+	devMap := make(map[string]*Device)
+	for _, path := range append([]string{devicePath}, lunDevicePaths(sessions, target)...) {
+		iscsi.lsblkDevices(ctx, path, devMap)
+	}
+
+	return devMap, false
+}
+
+// lsblkDevices adds devicePath and its holders, such as the multipath device, to devMap.
+func (iscsi *ISCSIUtil) lsblkDevices(ctx context.Context, devicePath string, devMap map[string]*Device) {
+	args := []string{"-rn", "-o", "NAME,KNAME,PKNAME,TYPE,STATE,SIZE,VENDOR,MODEL,WWN"}
+	out, err := iscsi.execCmd(ctx, "lsblk", append(args, []string{devicePath}...)...)
+	if err != nil {
+		iscsi.logger().V(2).Info("Failed to get disk path", "devicePath", devicePath, "err", err)
+		return
+	}
+
+	lines := strings.Split(strings.Trim(string(out), "\n"), "\n")
+	for _, line := range lines {
+		tokens := strings.Split(line, " ")
+		iscsi.logger().V(2).Info("Device info", "device", tokens[1], "info", tokens)
+		dev := &Device{
+			Name:   tokens[0],
+			Type:   tokens[3],
+			State:  tokens[4],
+			Size:   tokens[5],
+			Vendor: tokens[6],
+			Model:  tokens[7],
+			Serial: tokens[8],
+		}
+		devMap[tokens[1]] = dev
+	}
+}
+
+// getMountPoints returns the mount points of devicePath and its holders.
+func (iscsi *ISCSIUtil) getMountPoints(ctx context.Context, devicePath string) []string {
+	var mnts []string
+	out, err := iscsi.execCmd(ctx, "lsblk", "-rn", "-o", "MOUNTPOINT", devicePath)
+	if err != nil {
+		iscsi.logger().V(2).Info("Failed to get mount points", "device", devicePath, "err", err)
+		return mnts
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			mnts = append(mnts, line)
+		}
+	}
+
+	return mnts
+}
+
+func (iscsi *ISCSIUtil) hasMntDevices(ctx context.Context, targets []*Target) (bool, error) {
 	cnt, total := 0, 0
-	prefixDir := "/dev/disk/by-path/"
+	prefixDir := byPathDir
 
 	var devPaths []string
 	for _, target := range targets {
-		devPrefixName := strings.Join([]string{"ip", target.Portal, "iscsi", target.Name, "lun"}, "-")
+		devPrefixNames := byPathPrefixes(target)
 
 		files, err := ioutil.ReadDir(prefixDir)
 		if err != nil {
@@ -139,19 +250,19 @@ func hasMntDevices(targets []*Target) (bool, error) {
 		}
 
 		for _, file := range files {
-			if strings.HasPrefix(file.Name(), devPrefixName) {
+			if hasAnyPrefix(file.Name(), devPrefixNames) {
 				total++
 
 				args := []string{"-rn", "-o", "NAME,KNAME,MOUNTPOINT"}
 				devicePath := prefixDir + file.Name()
-				out, err := execCmd("lsblk", append(args, []string{devicePath}...)...)
+				out, err := iscsi.execCmd(ctx, "lsblk", append(args, []string{devicePath}...)...)
 				if err == nil {
 					line := strings.Trim(string(out), "\n")
 					tokens := strings.Split(line, " ")
 					devPaths = append(devPaths, tokens[1])
 					mntPath := tokens[2]
 					if len(mntPath) > 0 {
-						glog.V(2).Infof("[hasMntDevices] %s, mountpoint(%s)\n", file.Name(), mntPath)
+						iscsi.logger().V(2).Info("Found mounted device path", "device", file.Name(), "mountPoint", mntPath)
 						cnt++
 					}
 				}
@@ -159,7 +270,7 @@ func hasMntDevices(targets []*Target) (bool, error) {
 		}
 	}
 
-	glog.V(2).Infof("[hasMntDevices] cnt: %d/%d, devPaths: %+v\n", cnt, total, devPaths)
+	iscsi.logger().V(2).Info("Mounted device paths", "mountedCnt", cnt, "totalCnt", total, "devices", devPaths)
 
 	mounter := &mount.SafeFormatAndMount{
 		Interface: mount.New(""),
@@ -167,13 +278,13 @@ func hasMntDevices(targets []*Target) (bool, error) {
 	}
 	mnts, err := mounter.List()
 	if err != nil {
-		glog.V(2).Infof("[hasMntDevices] List mount err: %v\n", err)
+		iscsi.logger().V(2).Info("Failed to list mounts", "err", err)
 	}
 	for _, mp := range mnts {
 		var devName string
 		if mp.Device == "udev" {
 			args := []string{"-rn", "-o", "KNAME"}
-			out, err := execCmd("lsblk", append(args, []string{mp.Path}...)...)
+			out, err := iscsi.execCmd(ctx, "lsblk", append(args, []string{mp.Path}...)...)
 			if err == nil {
 				devName = strings.Trim(string(out), "\n")
 			}
@@ -185,7 +296,7 @@ func hasMntDevices(targets []*Target) (bool, error) {
 		}
 
 		if len(devName) > 0 && contains(devPaths, devName) {
-			glog.V(2).Infof("[hasMntDevices] Found %s path(%s) devName(%s)\n", mp.Device, mp.Path, devName)
+			iscsi.logger().V(2).Info("Found mounted device", "device", devName, "mountDevice", mp.Device, "mountPoint", mp.Path)
 			return true, nil
 		}
 	}
@@ -199,7 +310,7 @@ func hasMntDevices(targets []*Target) (bool, error) {
 
 func lunSessionExists(sessions []*Session, target *Target) bool {
 	for _, sess := range sessions {
-		if sess.Portal == target.Portal && sess.Target == target.Name {
+		if sess.Portal == canonicalPortal(target.Portal) && sess.Target == target.Name && sessionIfaceMatches(sess, target.Iface) {
 			for _, scsiDev := range sess.SCSIDevices {
 				if scsiDev.Lun == target.Lun {
 					return true
@@ -211,12 +322,110 @@ func lunSessionExists(sessions []*Session, target *Target) bool {
 	return false
 }
 
+// lunDevicePaths returns the /dev paths of the target LUN attached to every
+// session of the target.
+func lunDevicePaths(sessions []*Session, target *Target) []string {
+	var paths []string
+	for _, sess := range sessions {
+		if sess.Portal == canonicalPortal(target.Portal) && sess.Target == target.Name && sessionIfaceMatches(sess, target.Iface) {
+			for _, scsiDev := range sess.SCSIDevices {
+				if scsiDev.Lun == target.Lun && scsiDev.Name != "" {
+					paths = append(paths, "/dev/"+scsiDev.Name)
+				}
+			}
+		}
+	}
+
+	return paths
+}
+
+func targetSessionCount(sessions []*Session, target *Target) (int, *Session) {
+	cnt := 0
+	var first *Session
+	for _, sess := range sessions {
+		if sess.Portal == canonicalPortal(target.Portal) && sess.Target == target.Name && sessionIfaceMatches(sess, target.Iface) {
+			if first == nil {
+				first = sess
+			}
+			cnt++
+		}
+	}
+
+	return cnt, first
+}
+
+// sessionIface returns the iface name of the session of target, or empty if the
+// target has no iface binding.
+func sessionIface(sessions []*Session, target *Target) string {
+	if target.Iface == "" {
+		return ""
+	}
+
+	for _, sess := range sessions {
+		if sess.Portal == canonicalPortal(target.Portal) && sess.Target == target.Name && sessionIfaceMatches(sess, target.Iface) {
+			return sess.Iface
+		}
+	}
+
+	return ""
+}
+
 func targetSessionExists(sessions []*Session, target *Target) bool {
 	for _, sess := range sessions {
-		if sess.Portal == target.Portal && sess.Target == target.Name {
+		if sess.Portal == canonicalPortal(target.Portal) && sess.Target == target.Name && sessionIfaceMatches(sess, target.Iface) {
 			return true
 		}
 	}
 
 	return false
 }
+
+// sessionOfTarget reports whether sess is a session of target, whatever its LUN.
+func sessionOfTarget(sess *Session, target *Target) bool {
+	return sess.Portal == canonicalPortal(target.Portal) && sess.Target == target.Name && sessionIfaceMatches(sess, target.Iface)
+}
+
+func validateTargets(targets []*Target) error {
+	for _, target := range targets {
+		if err := iscsiname.Validate(target.Name); err != nil {
+			return fmt.Errorf("Invalid target name, err: %v", err)
+		}
+		if _, err := iscsiname.ParsePortal(target.Portal); err != nil {
+			return fmt.Errorf("Invalid target portal, err: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// canonicalPortal returns portal in the normalized host:port form used for
+// iscsiadm arguments and session comparison, e.g. "[fe80::1]:3260". Session
+// portals printed by iscsiadm carry a ",tpgt" suffix which is dropped.
+// Unparsable portals are returned unchanged.
+func canonicalPortal(portal string) string {
+	if i := strings.LastIndex(portal, ","); i >= 0 {
+		portal = portal[:i]
+	}
+
+	p, err := iscsiname.ParsePortal(portal)
+	if err != nil {
+		return portal
+	}
+	return p.String()
+}
+
+// byPathPrefixes returns the candidate /dev/disk/by-path link name prefixes of
+// the target LUNs. IPv6 addresses are expected without brackets, as udev names
+// them, with the bracketed form kept as a fallback.
+func byPathPrefixes(target *Target) []string {
+	p, err := iscsiname.ParsePortal(target.Portal)
+	if err != nil {
+		return []string{strings.Join([]string{"ip", target.Portal, "iscsi", target.Name, "lun", ""}, "-")}
+	}
+
+	prefixes := []string{p.ByPathPrefix(target.Name)}
+	if p.IsIPv6() {
+		prefixes = append(prefixes, "ip-"+p.String()+"-iscsi-"+target.Name+"-lun-")
+	}
+	return prefixes
+}
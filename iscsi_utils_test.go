@@ -0,0 +1,230 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTargetSessionExistsIPv6(t *testing.T) {
+	sessions := []*Session{
+		{Portal: canonicalPortal("[fe80::1]:3260,1"), Target: "iqn.2004-08.com.qsan:dev3.ctr1"},
+		{Portal: canonicalPortal("192.168.206.51:3260,1"), Target: "iqn.2004-08.com.qsan:dev3.ctr2"},
+	}
+
+	tests := []struct {
+		portal string
+		name   string
+		exists bool
+	}{
+		{"[fe80::1]:3260", "iqn.2004-08.com.qsan:dev3.ctr1", true},
+		{"fe80::1", "iqn.2004-08.com.qsan:dev3.ctr1", true},
+		{"[FE80:0::1]", "iqn.2004-08.com.qsan:dev3.ctr1", true},
+		{"[fe80::1]:3261", "iqn.2004-08.com.qsan:dev3.ctr1", false},
+		{"192.168.206.51", "iqn.2004-08.com.qsan:dev3.ctr2", true},
+		{"192.168.206.51:3260", "iqn.2004-08.com.qsan:dev3.ctr1", false},
+	}
+
+	for _, tt := range tests {
+		target := &Target{Portal: tt.portal, Name: tt.name}
+		if exists := targetSessionExists(sessions, target); exists != tt.exists {
+			t.Errorf("targetSessionExists(%s, %s) = %v, expect %v", tt.portal, tt.name, exists, tt.exists)
+		}
+	}
+}
+
+func TestByPathPrefixes(t *testing.T) {
+	prefixes := byPathPrefixes(&Target{Portal: "[fe80::1]:3260", Name: "iqn.2004-08.com.qsan:dev3"})
+	if len(prefixes) != 2 || prefixes[0] != "ip-fe80::1:3260-iscsi-iqn.2004-08.com.qsan:dev3-lun-" ||
+		prefixes[1] != "ip-[fe80::1]:3260-iscsi-iqn.2004-08.com.qsan:dev3-lun-" {
+		t.Fatalf("unexpected IPv6 prefixes: %v", prefixes)
+	}
+
+	prefixes = byPathPrefixes(&Target{Portal: "192.168.206.50", Name: "iqn.2004-08.com.qsan:dev3"})
+	if len(prefixes) != 1 || prefixes[0] != "ip-192.168.206.50:3260-iscsi-iqn.2004-08.com.qsan:dev3-lun-" {
+		t.Fatalf("unexpected IPv4 prefixes: %v", prefixes)
+	}
+}
+
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := r[host]; ok {
+		return addrs, nil
+	}
+	return nil, fmt.Errorf("no such host %s", host)
+}
+
+func TestResolveTargets(t *testing.T) {
+	util := &ISCSIUtil{Opts: ISCSIOptions{Resolver: fakeResolver{
+		"array-a.local": {"192.168.206.50", "192.168.206.60"},
+		"array-b.local": {"FE80::1"},
+	}}}
+	sessions := []*Session{
+		{Portal: "192.168.206.60:3260", Target: "iqn.2004-08.com.qsan:dev3.ctr1"},
+	}
+	targets := []*Target{
+		{Portal: "array-a.local:3260", Name: "iqn.2004-08.com.qsan:dev3.ctr1"},
+		{Portal: "array-b.local", Name: "iqn.2004-08.com.qsan:dev3.ctr2"},
+		{Portal: "unknown.local:3260", Name: "iqn.2004-08.com.qsan:dev3.ctr2"},
+		{Portal: "192.168.206.51:3260", Name: "iqn.2004-08.com.qsan:dev3.ctr2"},
+	}
+
+	resolved := util.resolveTargets(context.Background(), sessions, targets)
+	expects := []string{"192.168.206.60:3260", "[fe80::1]:3260", "unknown.local:3260", "192.168.206.51:3260"}
+	for i, target := range resolved {
+		if target.Portal != expects[i] {
+			t.Errorf("resolved portal of %s = %s, expect %s", targets[i].Portal, target.Portal, expects[i])
+		}
+	}
+
+	if resolved[0].portalName != "array-a.local:3260" || targets[0].Portal != "array-a.local:3260" {
+		t.Errorf("original portal is not kept: %+v, %+v", resolved[0], targets[0])
+	}
+	if !targetSessionExists(sessions, resolved[0]) {
+		t.Errorf("resolved target should match session")
+	}
+}
+
+// blockingResolver is a dead resolver, which only returns when ctx is done.
+type blockingResolver struct{}
+
+func (blockingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestResolveTargetsDeadline(t *testing.T) {
+	util := &ISCSIUtil{Opts: ISCSIOptions{Resolver: blockingResolver{}}}
+	targets := []*Target{
+		{Portal: "array-a.local:3260", Name: "iqn.2004-08.com.qsan:dev3.ctr1"},
+		{Portal: "array-b.local:3260", Name: "iqn.2004-08.com.qsan:dev3.ctr2"},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	resolved := util.resolveTargets(ctx, nil, targets)
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("resolveTargets took %v beyond the deadline of ctx", d)
+	}
+	if resolved[0].Portal != "array-a.local:3260" || resolved[1].Portal != "array-b.local:3260" {
+		t.Errorf("unresolved targets should keep their portal: %+v, %+v", resolved[0], resolved[1])
+	}
+}
+
+func TestParseIfaces(t *testing.T) {
+	out := "default tcp,<empty>,<empty>,<empty>,<empty>\n" +
+		"iser iser,<empty>,<empty>,<empty>,<empty>\n" +
+		"eth1-iface tcp,00:11:22:33:44:55,192.168.206.10,eth1,<empty>\n"
+
+	ifaces := parseIfaces(out)
+	if len(ifaces) != 3 {
+		t.Fatalf("parseIfaces got %d ifaces, expect 3", len(ifaces))
+	}
+	expect := Iface{Name: "eth1-iface", Transport: "tcp", HWAddress: "00:11:22:33:44:55", IPAddress: "192.168.206.10", NetIfaceName: "eth1"}
+	if *ifaces[2] != expect {
+		t.Fatalf("parseIfaces got %+v, expect %+v", ifaces[2], expect)
+	}
+	if ifaces[0].HWAddress != "" {
+		t.Fatalf("<empty> should be parsed as empty string: %+v", ifaces[0])
+	}
+}
+
+func TestSessionIfaceMatches(t *testing.T) {
+	sess := &Session{Iface: "eth1-iface", IfaceHWAddress: "00:11:22:33:44:55"}
+	for iface, match := range map[string]bool{
+		"":                  true,
+		"eth1-iface":        true,
+		"eth2-iface":        false,
+		"00:11:22:33:44:55": true,
+		"00-11-22-33-44-55": true,
+		"00:11:22:33:44:56": false,
+	} {
+		if sessionIfaceMatches(sess, iface) != match {
+			t.Errorf("sessionIfaceMatches(%q) expect %v", iface, match)
+		}
+	}
+}
+
+func TestParseSessions(t *testing.T) {
+	out, err := os.ReadFile("testdata/session_p3.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := parseSessions(string(out))
+	if len(sessions) != 3 {
+		t.Fatalf("parseSessions got %d sessions, expect 3", len(sessions))
+	}
+
+	sess := sessions[1]
+	if sess.SID != 2 || sess.Portal != "192.168.206.50:3260" || sess.Iface != "eth1-iface" ||
+		sess.IfaceHWAddress != "00:11:22:33:44:55" || sess.State != "LOGGED_IN" || sess.Host != 4 {
+		t.Fatalf("unexpected session: %+v", sess)
+	}
+
+	sess = sessions[2]
+	if sess.Portal != "[fe80::1]:3260" || sess.State != "FAILED" || len(sess.SCSIDevices) != 1 ||
+		*sess.SCSIDevices[0] != (SCSIDevice{Lun: 0, Name: "sde", State: "blocked"}) {
+		t.Fatalf("unexpected IPv6 session: %+v", sess)
+	}
+
+	target := &Target{Portal: "192.168.206.50", Name: "iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr1"}
+	if cnt, first := targetSessionCount(sessions, target); cnt != 2 || first.SID != 1 {
+		t.Fatalf("targetSessionCount got %d, expect 2", cnt)
+	}
+	if paths := lunDevicePaths(sessions, target); len(paths) != 2 || paths[0] != "/dev/sdb" || paths[1] != "/dev/sdd" {
+		t.Fatalf("lunDevicePaths got %v", paths)
+	}
+
+	target.Iface = "eth1-iface"
+	if paths := lunDevicePaths(sessions, target); len(paths) != 1 || paths[0] != "/dev/sdd" {
+		t.Fatalf("lunDevicePaths with iface got %v", paths)
+	}
+}
+
+func TestForEach(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	done := make([]bool, 10)
+	forEach(context.Background(), len(done), 3, func(ctx context.Context, i int) {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+		done[i] = true
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+
+	if maxRunning > 3 {
+		t.Fatalf("forEach ran %d workers, expect at most 3", maxRunning)
+	}
+	for i, ok := range done {
+		if !ok {
+			t.Fatalf("forEach skipped index %d", i)
+		}
+	}
+}
+
+func TestSleepContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := sleepContext(ctx, time.Second); err != context.DeadlineExceeded || time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("sleepContext should return at ctx deadline, err: %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+// @2022 QSAN Inc. All right reserved
+
+// Package iscsiname parses and validates iSCSI names (RFC 3720, RFC 3721,
+// RFC 3980) and portal addresses.
+package iscsiname
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type Type int
+
+const (
+	IQN Type = iota + 1
+	EUI
+	NAA
+)
+
+const maxNameLen = 223
+
+func (t Type) String() string {
+	switch t {
+	case IQN:
+		return "iqn"
+	case EUI:
+		return "eui"
+	case NAA:
+		return "naa"
+	}
+	return "unknown"
+}
+
+// Name is a parsed iSCSI name. Date, Authority and Unique are only set for IQN
+// names, e.g. iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr1 has Date "2004-08",
+// Authority "com.qsan" and Unique "xf2026-000d42f58:dev3.ctr1". Hex holds the
+// identifier of EUI and NAA names.
+type Name struct {
+	Type      Type
+	Date      string
+	Authority string
+	Unique    string
+	Hex       string
+}
+
+// Parse parses an iqn., eui. or naa. name. IQN names are case-insensitive and
+// are normalized to lower case.
+func Parse(s string) (*Name, error) {
+	if len(s) == 0 {
+		return nil, fmt.Errorf("empty iSCSI name")
+	}
+	if len(s) > maxNameLen {
+		return nil, fmt.Errorf("iSCSI name is longer than %d bytes: %s", maxNameLen, s)
+	}
+
+	lower := strings.ToLower(s)
+	switch {
+	case strings.HasPrefix(lower, "iqn."):
+		return parseIQN(s, lower)
+	case strings.HasPrefix(lower, "eui."):
+		hex, err := parseHex(s, lower[4:], 16)
+		if err != nil {
+			return nil, err
+		}
+		return &Name{Type: EUI, Hex: hex}, nil
+	case strings.HasPrefix(lower, "naa."):
+		hex, err := parseHex(s, lower[4:], 16, 32)
+		if err != nil {
+			return nil, err
+		}
+		return &Name{Type: NAA, Hex: hex}, nil
+	}
+
+	return nil, fmt.Errorf("iSCSI name must start with iqn., eui. or naa.: %s", s)
+}
+
+// Validate returns an error if s is not a valid iSCSI name.
+func Validate(s string) error {
+	_, err := Parse(s)
+	return err
+}
+
+func (n *Name) String() string {
+	switch n.Type {
+	case IQN:
+		s := "iqn." + n.Date + "." + n.Authority
+		if n.Unique != "" {
+			s += ":" + n.Unique
+		}
+		return s
+	case EUI, NAA:
+		return n.Type.String() + "." + n.Hex
+	}
+	return ""
+}
+
+func parseIQN(s, lower string) (*Name, error) {
+	rest := lower[4:]
+	if len(rest) < 8 || rest[7] != '.' {
+		return nil, fmt.Errorf("IQN must contain a yyyy-mm date: %s", s)
+	}
+
+	date := rest[:7]
+	year, yerr := strconv.Atoi(date[:4])
+	month, merr := strconv.Atoi(date[5:])
+	if date[4] != '-' || yerr != nil || merr != nil || year < 1000 || month < 1 || month > 12 {
+		return nil, fmt.Errorf("IQN has invalid date %q: %s", date, s)
+	}
+
+	authority, unique := rest[8:], ""
+	if i := strings.Index(authority, ":"); i >= 0 {
+		authority, unique = authority[:i], authority[i+1:]
+		if unique == "" {
+			return nil, fmt.Errorf("IQN has empty string after ':': %s", s)
+		}
+	}
+
+	if authority == "" {
+		return nil, fmt.Errorf("IQN has no naming authority: %s", s)
+	}
+	for _, label := range strings.Split(authority, ".") {
+		if !isLabel(label) {
+			return nil, fmt.Errorf("IQN has invalid naming authority %q: %s", authority, s)
+		}
+	}
+
+	for _, c := range unique {
+		if !isNameChar(c) {
+			return nil, fmt.Errorf("IQN contains invalid character %q: %s", c, s)
+		}
+	}
+
+	return &Name{Type: IQN, Date: date, Authority: authority, Unique: unique}, nil
+}
+
+func parseHex(s, hex string, lengths ...int) (string, error) {
+	valid := false
+	for _, l := range lengths {
+		if len(hex) == l {
+			valid = true
+		}
+	}
+	if !valid {
+		return "", fmt.Errorf("%s name must have %v hex digits: %s", strings.ToUpper(s[:3]), lengths, s)
+	}
+
+	for _, c := range hex {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return "", fmt.Errorf("%s name contains non-hex character %q: %s", strings.ToUpper(s[:3]), c, s)
+		}
+	}
+
+	return strings.ToUpper(hex), nil
+}
+
+// isLabel reports whether s is a domain name label made of letters, digits and '-'.
+func isLabel(s string) bool {
+	if len(s) == 0 || len(s) > 63 || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// isNameChar reports whether c is allowed in a normalized iSCSI name.
+func isNameChar(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == ':'
+}
@@ -0,0 +1,120 @@
+// @2022 QSAN Inc. All right reserved
+
+package iscsiname
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in    string
+		valid bool
+		out   string
+	}{
+		{"iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr1", true, "iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr1"},
+		{"IQN.2004-08.com.QSAN:Dev3", true, "iqn.2004-08.com.qsan:dev3"},
+		{"iqn.1991-05.com.microsoft", true, "iqn.1991-05.com.microsoft"},
+		{"eui.02004567a425678d", true, "eui.02004567A425678D"},
+		{"naa.52004567BA64678D", true, "naa.52004567BA64678D"},
+		{"naa.62004567BA64678D0123456789ABCDEF", true, "naa.62004567BA64678D0123456789ABCDEF"},
+		{"", false, ""},
+		{"iqn.2004-13.com.qsan:dev", false, ""},
+		{"iqn.04-08.com.qsan:dev", false, ""},
+		{"iqn.2004-08:dev", false, ""},
+		{"iqn.2004-08.com.qsan:", false, ""},
+		{"iqn.2004-08.com.qsan:dev 3", false, ""},
+		{"iqn.2004-08.com..qsan:dev", false, ""},
+		{"iqn.2004-08.com.qsan:dev_3", false, ""},
+		{"eui.02004567A425678", false, ""},
+		{"naa.52004567BA64678Z", false, ""},
+		{"192.168.206.50:3260", false, ""},
+	}
+
+	for _, tt := range tests {
+		n, err := Parse(tt.in)
+		if (err == nil) != tt.valid {
+			t.Errorf("Parse(%q) err: %v, expect valid=%v", tt.in, err, tt.valid)
+			continue
+		}
+		if err == nil && n.String() != tt.out {
+			t.Errorf("Parse(%q) = %q, expect %q", tt.in, n.String(), tt.out)
+		}
+	}
+}
+
+func TestParseIQNFields(t *testing.T) {
+	n, err := Parse("iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Type != IQN || n.Date != "2004-08" || n.Authority != "com.qsan" || n.Unique != "xf2026-000d42f58:dev3.ctr1" {
+		t.Fatalf("unexpected fields: %+v", n)
+	}
+}
+
+func TestParsePortal(t *testing.T) {
+	tests := []struct {
+		in    string
+		valid bool
+		out   string
+	}{
+		{"192.168.206.50:3260", true, "192.168.206.50:3260"},
+		{"192.168.206.50", true, "192.168.206.50:3260"},
+		{" 192.168.206.50:3261 ", true, "192.168.206.50:3261"},
+		{"[fe80::1]:3260", true, "[fe80::1]:3260"},
+		{"[FE80:0:0:0:0:0:0:1]", true, "[fe80::1]:3260"},
+		{"fe80::1", true, "[fe80::1]:3260"},
+		{"[fe80::1%eth0]:3260", true, "[fe80::1%eth0]:3260"},
+		{"Array-A.local:3260", true, "array-a.local:3260"},
+		{"array-a", true, "array-a:3260"},
+		{"", false, ""},
+		{"192.168.206.50:", false, ""},
+		{"192.168.206.50:0", false, ""},
+		{"192.168.206.50:65536", false, ""},
+		{"192.168.206.50:port", false, ""},
+		{"[192.168.206.50]:3260", false, ""},
+		{"[fe80::1:3260", false, ""},
+		{"[fe80::1]3260", false, ""},
+		{"array_a:3260", false, ""},
+		{"-array:3260", false, ""},
+	}
+
+	for _, tt := range tests {
+		p, err := ParsePortal(tt.in)
+		if (err == nil) != tt.valid {
+			t.Errorf("ParsePortal(%q) err: %v, expect valid=%v", tt.in, err, tt.valid)
+			continue
+		}
+		if err == nil && p.String() != tt.out {
+			t.Errorf("ParsePortal(%q) = %q, expect %q", tt.in, p.String(), tt.out)
+		}
+	}
+}
+
+func TestPortalByPathName(t *testing.T) {
+	tests := []struct {
+		in  string
+		out string
+	}{
+		{"192.168.206.50", "ip-192.168.206.50:3260-iscsi-iqn.2004-08.com.qsan:dev3-lun-1"},
+		{"[fe80::1]:3260", "ip-fe80::1:3260-iscsi-iqn.2004-08.com.qsan:dev3-lun-1"},
+	}
+
+	for _, tt := range tests {
+		p, err := ParsePortal(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name := p.ByPathName("iqn.2004-08.com.qsan:dev3", 1); name != tt.out {
+			t.Errorf("ByPathName(%q) = %q, expect %q", tt.in, name, tt.out)
+		}
+	}
+}
+
+func TestPortalEqual(t *testing.T) {
+	a, _ := ParsePortal("[FE80:0:0::1]:3260")
+	b, _ := ParsePortal("fe80::1")
+	c, _ := ParsePortal("[fe80::1]:3261")
+	if !a.Equal(b) || a.Equal(c) {
+		t.Fatalf("unexpected Equal result: %v %v", a, c)
+	}
+}
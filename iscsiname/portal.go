@@ -0,0 +1,142 @@
+// @2022 QSAN Inc. All right reserved
+
+package iscsiname
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DefaultPort is the well-known iSCSI TCP port.
+const DefaultPort = "3260"
+
+// Portal is a parsed portal address. Host is an IP address or a host name,
+// IPv6 addresses are stored without brackets.
+type Portal struct {
+	Host string
+	Port string
+}
+
+// ParsePortal parses portals such as "192.168.1.1", "192.168.1.1:3260",
+// "array-a.local:3260", "fe80::1", "[fe80::1]" or "[fe80::1%eth0]:3260".
+// DefaultPort is used when the port is omitted. IP addresses are normalized
+// and host names are lower cased.
+func ParsePortal(s string) (*Portal, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, fmt.Errorf("empty portal")
+	}
+
+	host, port := "", DefaultPort
+	bracketed := false
+	switch {
+	case strings.HasPrefix(s, "["):
+		end := strings.Index(s, "]")
+		if end < 0 {
+			return nil, fmt.Errorf("portal has unclosed bracket: %s", s)
+		}
+		host, bracketed = s[1:end], true
+		rest := s[end+1:]
+		if rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return nil, fmt.Errorf("portal has invalid characters after ']': %s", s)
+			}
+			port = rest[1:]
+		}
+	case strings.Count(s, ":") > 1:
+		// Bare IPv6 address without port
+		host = s
+	case strings.Contains(s, ":"):
+		host, port = s[:strings.Index(s, ":")], s[strings.Index(s, ":")+1:]
+	default:
+		host = s
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 || port[0] == '0' {
+		return nil, fmt.Errorf("portal has invalid port %q: %s", port, s)
+	}
+
+	if ip, zone := parseIP(host); ip != nil {
+		if bracketed && ip.To4() != nil {
+			return nil, fmt.Errorf("portal has bracketed IPv4 address: %s", s)
+		}
+		host = ip.String()
+		if zone != "" {
+			host += "%" + zone
+		}
+	} else {
+		if bracketed || !isHostname(host) {
+			return nil, fmt.Errorf("portal has invalid host %q: %s", host, s)
+		}
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+
+	return &Portal{Host: host, Port: port}, nil
+}
+
+// String returns the portal as host:port, with IPv6 addresses in brackets.
+// This is the form accepted by iscsiadm -p.
+func (p *Portal) String() string {
+	return net.JoinHostPort(p.Host, p.Port)
+}
+
+// ByPathName returns the /dev/disk/by-path link name udev creates for the LUN
+// of target iqn reached through this portal. udev uses the node record address
+// as is, so IPv6 addresses appear without brackets, e.g.
+// ip-fe80::1:3260-iscsi-iqn.2004-08.com.qsan:dev3-lun-0.
+func (p *Portal) ByPathName(iqn string, lun uint64) string {
+	return p.ByPathPrefix(iqn) + strconv.FormatUint(lun, 10)
+}
+
+// ByPathPrefix returns the by-path link name prefix shared by all LUNs of target iqn.
+func (p *Portal) ByPathPrefix(iqn string) string {
+	return "ip-" + p.Host + ":" + p.Port + "-iscsi-" + iqn + "-lun-"
+}
+
+// Equal reports whether both portals refer to the same host and port.
+func (p *Portal) Equal(o *Portal) bool {
+	return o != nil && p.Host == o.Host && p.Port == o.Port
+}
+
+// IsIP reports whether the portal host is an IP address rather than a host name.
+func (p *Portal) IsIP() bool {
+	ip, _ := parseIP(p.Host)
+	return ip != nil
+}
+
+// IsIPv6 reports whether the portal host is an IPv6 address.
+func (p *Portal) IsIPv6() bool {
+	ip, _ := parseIP(p.Host)
+	return ip != nil && ip.To4() == nil
+}
+
+func parseIP(host string) (net.IP, string) {
+	var zone string
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host, zone = host[:i], host[i+1:]
+		if zone == "" {
+			return nil, ""
+		}
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || (zone != "" && ip.To4() != nil) {
+		return nil, ""
+	}
+	return ip, zone
+}
+
+func isHostname(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if len(s) == 0 || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.ToLower(s), ".") {
+		if !isLabel(label) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// keyMutex serializes operations by key, e.g. per target.
+type keyMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// targetLocks is shared by all ISCSIUtil instances, since they share the
+// iscsiadm node database of the host.
+var targetLocks = &keyMutex{locks: make(map[string]*keyLock)}
+
+func (m *keyMutex) lock(key string) func() {
+	m.mu.Lock()
+	l, ok := m.locks[key]
+	if !ok {
+		l = &keyLock{}
+		m.locks[key] = l
+	}
+	l.refs++
+	m.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		m.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(m.locks, key)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// targetLockKey identifies the node record of target by portal, IQN and iface.
+func targetLockKey(target *Target) string {
+	return canonicalPortal(target.Portal) + "," + target.Name + "," + target.Iface
+}
+
+// lockTarget serializes operations on target within the process and, if
+// ISCSIOptions.LockDir is set, with other processes by an flock on a file
+// named after the target. The returned function releases both locks.
+func (iscsi *ISCSIUtil) lockTarget(target *Target) (func(), error) {
+	key := targetLockKey(target)
+	unlock := targetLocks.lock(key)
+	if iscsi.Opts.LockDir == "" {
+		return unlock, nil
+	}
+
+	if err := os.MkdirAll(iscsi.Opts.LockDir, 0700); err != nil {
+		unlock()
+		return nil, err
+	}
+
+	sum := sha1.Sum([]byte(key))
+	file, err := lockFile(filepath.Join(iscsi.Opts.LockDir, hex.EncodeToString(sum[:])+".lock"), true)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+
+	return func() {
+		unlockFile(file)
+		unlock()
+	}, nil
+}
+
+// lockTargets locks each distinct target in key order, so that callers holding
+// several targets cannot deadlock. The returned function releases all locks.
+func (iscsi *ISCSIUtil) lockTargets(targets []*Target) (func(), error) {
+	byKey := make(map[string]*Target)
+	keys := make([]string, 0, len(targets))
+	for _, target := range targets {
+		key := targetLockKey(target)
+		if _, ok := byKey[key]; !ok {
+			byKey[key] = target
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	unlocks := make([]func(), 0, len(keys))
+	unlockAll := func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+	for _, key := range keys {
+		unlock, err := iscsi.lockTarget(byKey[key])
+		if err != nil {
+			unlockAll()
+			return nil, err
+		}
+		unlocks = append(unlocks, unlock)
+	}
+
+	return unlockAll, nil
+}
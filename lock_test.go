@@ -0,0 +1,111 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockTarget(t *testing.T) {
+	dir := t.TempDir()
+	util := &ISCSIUtil{Opts: ISCSIOptions{LockDir: dir}}
+	target := &Target{Portal: "192.168.206.50", Name: "iqn.2004-08.com.qsan:dev3.ctr1"}
+	// Same node record as target, with the portal in another form
+	same := &Target{Portal: "192.168.206.50:3260", Name: "iqn.2004-08.com.qsan:dev3.ctr1"}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	running, maxRunning := 0, 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tgt := target
+			if i%2 == 1 {
+				tgt = same
+			}
+			unlock, err := util.lockTarget(tgt)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer unlock()
+
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	if maxRunning != 1 {
+		t.Fatalf("lockTarget allowed %d concurrent holders", maxRunning)
+	}
+	if len(targetLocks.locks) != 0 {
+		t.Fatalf("lock entries are not released: %d", len(targetLocks.locks))
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("expect one lock file, got %d", len(files))
+	}
+
+	other := &Target{Portal: "192.168.206.51", Name: "iqn.2004-08.com.qsan:dev3.ctr2"}
+	unlock, _ := util.lockTarget(target)
+	done := make(chan struct{})
+	go func() {
+		unlockOther, _ := util.lockTarget(other)
+		unlockOther()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("locks of different targets should not block each other")
+	}
+	unlock()
+}
+
+func TestLockTargets(t *testing.T) {
+	util := &ISCSIUtil{}
+	a := &Target{Portal: "192.168.206.50", Name: "iqn.2004-08.com.qsan:dev3.ctr1"}
+	b := &Target{Portal: "192.168.206.51", Name: "iqn.2004-08.com.qsan:dev3.ctr2"}
+	// The same node record twice must not deadlock
+	aSame := &Target{Portal: "192.168.206.50:3260", Name: "iqn.2004-08.com.qsan:dev3.ctr1"}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			unlock, err := util.lockTargets([]*Target{b, a})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			unlock()
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		unlock, err := util.lockTargets([]*Target{a, b, aSame})
+		if err != nil {
+			t.Fatal(err)
+		}
+		unlock()
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("lockTargets deadlocked")
+	}
+	if len(targetLocks.locks) != 0 {
+		t.Fatalf("lock entries are not released: %d", len(targetLocks.locks))
+	}
+}
@@ -0,0 +1,168 @@
+// @2022 QSAN Inc. All right reserved
+
+// Package metrics exports goiscsi operations, sessions and volume disks as
+// Prometheus metrics.
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/QsanJohnson/goiscsi"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "goiscsi"
+
+// diskStatuses are the values of goiscsi.Disk.Status.
+var diskStatuses = []string{"none", "mismatch", "online", "offline", "degrade", "unknown"}
+
+// Metrics is a prometheus.Collector and a goiscsi.Observer. Set it as
+// ISCSIOptions.Observer to count operations, and call ObserveDisk with the
+// Disk of each volume to export its status and paths. Session metrics are
+// read from the session snapshot of iscsi at collection time.
+type Metrics struct {
+	iscsi *goiscsi.ISCSIUtil
+
+	operations   *prometheus.CounterVec
+	durations    *prometheus.HistogramVec
+	volumePaths  *prometheus.GaugeVec
+	volumeStatus *prometheus.GaugeVec
+	sessions     *prometheus.Desc
+	sessionPaths *prometheus.Desc
+
+	mu sync.Mutex
+}
+
+// New returns the metrics of iscsi. Session metrics are not exported if iscsi is nil.
+func New(iscsi *goiscsi.ISCSIUtil) *Metrics {
+	return &Metrics{
+		iscsi: iscsi,
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "operations_total",
+			Help:      "Number of operations by operation and result.",
+		}, []string{"operation", "result"}),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "operation_duration_seconds",
+			Help:      "Duration of operations in seconds.",
+			Buckets:   []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+		}, []string{"operation"}),
+		volumePaths: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "volume_paths",
+			Help:      "Number of SCSI disk paths of a volume by device state.",
+		}, []string{"volume", "state"}),
+		volumeStatus: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "volume_status",
+			Help:      "Disk status of a volume, 1 for the current status.",
+		}, []string{"volume", "status"}),
+		sessions: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "sessions"),
+			"Number of sessions by target, portal, iface and session state.",
+			[]string{"target", "portal", "iface", "state"}, nil),
+		sessionPaths: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "session_paths"),
+			"Number of attached SCSI devices of sessions by target, portal, iface and device state.",
+			[]string{"target", "portal", "iface", "state"}, nil),
+	}
+}
+
+// ObserveOperation implements goiscsi.Observer.
+func (m *Metrics) ObserveOperation(op string, d time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	m.operations.WithLabelValues(op, result).Inc()
+	m.durations.WithLabelValues(op).Observe(d.Seconds())
+}
+
+// ObserveDisk records the status and paths of the disk of volume.
+func (m *Metrics) ObserveDisk(volume string, disk *goiscsi.Disk) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deleteVolume(volume)
+	for _, status := range diskStatuses {
+		var v float64
+		if status == disk.Status {
+			v = 1
+		}
+		m.volumeStatus.WithLabelValues(volume, status).Set(v)
+	}
+	for _, dev := range disk.Devices {
+		if dev.Type == "disk" {
+			m.volumePaths.WithLabelValues(volume, dev.State).Inc()
+		}
+	}
+}
+
+// ObserveVolumes records the disk of each volume attached by AttachVolumes.
+func (m *Metrics) ObserveVolumes(results []*goiscsi.VolumeResult) {
+	for _, result := range results {
+		if result.Disk != nil {
+			m.ObserveDisk(result.ID, result.Disk)
+		}
+	}
+}
+
+// DeleteVolume removes the metrics of a detached volume.
+func (m *Metrics) DeleteVolume(volume string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.deleteVolume(volume)
+}
+
+func (m *Metrics) deleteVolume(volume string) {
+	m.volumePaths.DeletePartialMatch(prometheus.Labels{"volume": volume})
+	m.volumeStatus.DeletePartialMatch(prometheus.Labels{"volume": volume})
+}
+
+// Describe implements prometheus.Collector.
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.operations.Describe(ch)
+	m.durations.Describe(ch)
+	m.volumePaths.Describe(ch)
+	m.volumeStatus.Describe(ch)
+	if m.iscsi != nil {
+		ch <- m.sessions
+		ch <- m.sessionPaths
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.operations.Collect(ch)
+	m.durations.Collect(ch)
+
+	m.mu.Lock()
+	m.volumePaths.Collect(ch)
+	m.volumeStatus.Collect(ch)
+	m.mu.Unlock()
+
+	if m.iscsi != nil {
+		m.collectSessions(ch, m.iscsi.GetSession())
+	}
+}
+
+func (m *Metrics) collectSessions(ch chan<- prometheus.Metric, sessions []*goiscsi.Session) {
+	sessionCnt := make(map[[4]string]int)
+	pathCnt := make(map[[4]string]int)
+	for _, sess := range sessions {
+		sessionCnt[[4]string{sess.Target, sess.Portal, sess.Iface, sess.State}]++
+		for _, scsiDev := range sess.SCSIDevices {
+			if scsiDev.Name != "" {
+				pathCnt[[4]string{sess.Target, sess.Portal, sess.Iface, scsiDev.State}]++
+			}
+		}
+	}
+
+	for l, cnt := range sessionCnt {
+		ch <- prometheus.MustNewConstMetric(m.sessions, prometheus.GaugeValue, float64(cnt), l[0], l[1], l[2], l[3])
+	}
+	for l, cnt := range pathCnt {
+		ch <- prometheus.MustNewConstMetric(m.sessionPaths, prometheus.GaugeValue, float64(cnt), l[0], l[1], l[2], l[3])
+	}
+}
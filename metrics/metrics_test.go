@@ -0,0 +1,90 @@
+// @2022 QSAN Inc. All right reserved
+
+package metrics
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/QsanJohnson/goiscsi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveOperation(t *testing.T) {
+	m := New(nil)
+	m.ObserveOperation(goiscsi.OpLogin, time.Second, nil)
+	m.ObserveOperation(goiscsi.OpLogin, time.Second, errors.New("login failed"))
+	m.ObserveOperation(goiscsi.OpGetDisk, 2*time.Second, nil)
+
+	if v := testutil.ToFloat64(m.operations.WithLabelValues(goiscsi.OpLogin, "error")); v != 1 {
+		t.Fatalf("login errors got %v, expect 1", v)
+	}
+	if cnt := testutil.CollectAndCount(m.durations); cnt != 2 {
+		t.Fatalf("duration metrics got %d, expect 2", cnt)
+	}
+}
+
+func TestObserveDisk(t *testing.T) {
+	m := New(nil)
+	disk := &goiscsi.Disk{
+		Status: "degrade",
+		Devices: map[string]*goiscsi.Device{
+			"dm-0": {Type: "mpath", State: "running"},
+			"sdb":  {Type: "disk", State: "running"},
+			"sdc":  {Type: "disk", State: "offline"},
+		},
+	}
+	m.ObserveDisk("vol1", disk)
+
+	expected := `
+# HELP goiscsi_volume_paths Number of SCSI disk paths of a volume by device state.
+# TYPE goiscsi_volume_paths gauge
+goiscsi_volume_paths{state="offline",volume="vol1"} 1
+goiscsi_volume_paths{state="running",volume="vol1"} 1
+`
+	if err := testutil.CollectAndCompare(m.volumePaths, strings.NewReader(expected)); err != nil {
+		t.Fatal(err)
+	}
+	if v := testutil.ToFloat64(m.volumeStatus.WithLabelValues("vol1", "degrade")); v != 1 {
+		t.Fatalf("volume status degrade got %v, expect 1", v)
+	}
+
+	disk.Status = "online"
+	disk.Devices["sdc"].State = "running"
+	m.ObserveDisk("vol1", disk)
+	if v := testutil.ToFloat64(m.volumeStatus.WithLabelValues("vol1", "degrade")); v != 0 {
+		t.Fatalf("volume status degrade got %v, expect 0", v)
+	}
+	if v := testutil.ToFloat64(m.volumePaths.WithLabelValues("vol1", "running")); v != 2 {
+		t.Fatalf("running paths got %v, expect 2", v)
+	}
+
+	m.DeleteVolume("vol1")
+	if cnt := testutil.CollectAndCount(m.volumeStatus); cnt != 0 {
+		t.Fatalf("volume status metrics got %d after delete, expect 0", cnt)
+	}
+}
+
+func TestCollectSessions(t *testing.T) {
+	m := New(nil)
+	sessions := []*goiscsi.Session{
+		{SID: 1, Target: "iqn.2004-08.com.qsan:dev1.ctr1", Portal: "192.168.206.50:3260", Iface: "default", State: "LOGGED_IN",
+			SCSIDevices: []*goiscsi.SCSIDevice{{Lun: 0, Name: "sdb", State: "running"}, {Lun: 1, Name: "sdc", State: "running"}}},
+		{SID: 2, Target: "iqn.2004-08.com.qsan:dev1.ctr1", Portal: "192.168.206.50:3260", Iface: "default", State: "LOGGED_IN",
+			SCSIDevices: []*goiscsi.SCSIDevice{{Lun: 0, Name: "sdd", State: "running"}}},
+	}
+
+	ch := make(chan prometheus.Metric, 10)
+	m.collectSessions(ch, sessions)
+	close(ch)
+	cnt := 0
+	for range ch {
+		cnt++
+	}
+	if cnt != 2 {
+		t.Fatalf("session metrics got %d, expect 2", cnt)
+	}
+}
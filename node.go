@@ -0,0 +1,273 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/QsanJohnson/goiscsi/iscsiname"
+)
+
+// Node is an iscsiadm node record.
+type Node struct {
+	Target  string      `json:"target" yaml:"target"`
+	Portal  string      `json:"portal" yaml:"portal"`
+	Iface   string      `json:"iface" yaml:"iface"`
+	Startup string      `json:"startup,omitempty" yaml:"startup,omitempty"`
+	Config  *NodeConfig `json:"config,omitempty" yaml:"config,omitempty"`
+}
+
+const (
+	StartupManual    = "manual"    // Log in only on request
+	StartupAutomatic = "automatic" // Log in when iscsid starts, e.g. at boot
+	StartupOnBoot    = "onboot"    // Log in by initramfs for root on iSCSI
+)
+
+// NodeConfig holds the tunable settings of an iscsiadm node record.
+// Zero values leave the current settings unchanged when applied.
+type NodeConfig struct {
+	Startup            string `json:"startup,omitempty" yaml:"startup,omitempty"`                       // node.startup: manual, automatic or onboot
+	ReplacementTimeout int    `json:"replacementTimeout,omitempty" yaml:"replacementTimeout,omitempty"` // node.session.timeo.replacement_timeout, in seconds
+	NoopOutInterval    int    `json:"noopOutInterval,omitempty" yaml:"noopOutInterval,omitempty"`       // node.conn[0].timeo.noop_out_interval, in seconds
+	NoopOutTimeout     int    `json:"noopOutTimeout,omitempty" yaml:"noopOutTimeout,omitempty"`         // node.conn[0].timeo.noop_out_timeout, in seconds
+	HeaderDigest       string `json:"headerDigest,omitempty" yaml:"headerDigest,omitempty"`             // node.conn[0].iscsi.HeaderDigest: None, CRC32C, "CRC32C,None" or "None,CRC32C"
+	DataDigest         string `json:"dataDigest,omitempty" yaml:"dataDigest,omitempty"`                 // node.conn[0].iscsi.DataDigest
+	QueueDepth         int    `json:"queueDepth,omitempty" yaml:"queueDepth,omitempty"`                 // node.session.queue_depth
+	CmdsMax            int    `json:"cmdsMax,omitempty" yaml:"cmdsMax,omitempty"`                       // node.session.cmds_max
+}
+
+const (
+	nodeStartupKey            = "node.startup"
+	nodeConnStartupKey        = "node.conn[0].startup"
+	nodeReplacementTimeoutKey = "node.session.timeo.replacement_timeout"
+	nodeNoopOutIntervalKey    = "node.conn[0].timeo.noop_out_interval"
+	nodeNoopOutTimeoutKey     = "node.conn[0].timeo.noop_out_timeout"
+	nodeHeaderDigestKey       = "node.conn[0].iscsi.HeaderDigest"
+	nodeDataDigestKey         = "node.conn[0].iscsi.DataDigest"
+	nodeQueueDepthKey         = "node.session.queue_depth"
+	nodeCmdsMaxKey            = "node.session.cmds_max"
+)
+
+// UpdateNodeConfig applies cfg to the node records of targets. Sessions that are
+// already logged in keep their settings until they log in again.
+func (iscsi *ISCSIUtil) UpdateNodeConfig(targets []*Target, cfg *NodeConfig) error {
+	ctx := context.Background()
+	if err := validateTargets(targets); err != nil {
+		return err
+	}
+	args, err := cfg.updateArgs()
+	if err != nil {
+		return err
+	}
+
+	sessions := iscsi.sessions(ctx, false)
+	for _, target := range iscsi.resolveTargets(ctx, sessions, targets) {
+		unlock, err := iscsi.lockTarget(target)
+		if err != nil {
+			return err
+		}
+		err = iscsi.updateNode(ctx, sessions, target, args)
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetNodeConfig reads the node record of target.
+func (iscsi *ISCSIUtil) GetNodeConfig(target *Target) (*NodeConfig, error) {
+	ctx := context.Background()
+	if err := validateTargets([]*Target{target}); err != nil {
+		return nil, err
+	}
+
+	sessions := iscsi.sessions(ctx, false)
+	target = iscsi.resolveTargets(ctx, sessions, []*Target{target})[0]
+	baseArgs, err := iscsi.nodeArgs(ctx, sessions, target)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := iscsi.execCmd(ctx, "iscsiadm", baseArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get node config of %s, err: %v", target.Name, err)
+	}
+
+	records := parseNodeRecords(out)
+	if len(records) == 0 {
+		return nil, fmt.Errorf("Node record of %s not found", target.Name)
+	}
+
+	return nodeConfigFromRecord(records[0]), nil
+}
+
+// ListNodes returns all node records with their startup mode.
+func (iscsi *ISCSIUtil) ListNodes() ([]*Node, error) {
+	ctx := context.Background()
+	var nodes []*Node
+	out, err := iscsi.execCmd(ctx, "iscsiadm", "-m", "node", "-o", "show")
+	if err != nil {
+		if strings.Contains(err.Error(), "No records found") {
+			return nodes, nil
+		}
+		return nil, fmt.Errorf("Failed to list node, err: %v", err)
+	}
+
+	for _, record := range parseNodeRecords(out) {
+		nodes = append(nodes, nodeFromRecord(record))
+	}
+
+	return nodes, nil
+}
+
+// targetNodeConfig returns ISCSIOptions.NodeConfig with the startup mode of target applied.
+func (iscsi *ISCSIUtil) targetNodeConfig(target *Target) *NodeConfig {
+	if target.Startup == "" {
+		return iscsi.Opts.NodeConfig
+	}
+
+	cfg := NodeConfig{}
+	if iscsi.Opts.NodeConfig != nil {
+		cfg = *iscsi.Opts.NodeConfig
+	}
+	cfg.Startup = target.Startup
+	return &cfg
+}
+
+// updateNode applies the -n/-v pairs of args to the node record of target.
+func (iscsi *ISCSIUtil) updateNode(ctx context.Context, sessions []*Session, target *Target, args []string) error {
+	if len(args) == 0 {
+		return nil
+	}
+
+	baseArgs, err := iscsi.nodeArgs(ctx, sessions, target)
+	if err != nil {
+		return err
+	}
+	if _, err := iscsi.execCmd(ctx, "iscsiadm", append(append(baseArgs, "-o", "update"), args...)...); err != nil {
+		return fmt.Errorf("Failed to update node config of %s, err: %v", target.Name, err)
+	}
+
+	return nil
+}
+
+// nodeArgs returns the iscsiadm arguments selecting the node record of target.
+func (iscsi *ISCSIUtil) nodeArgs(ctx context.Context, sessions []*Session, target *Target) ([]string, error) {
+	baseArgs := []string{"-m", "node", "-T", target.Name, "-p", canonicalPortal(target.Portal)}
+	if target.Iface == "" {
+		return baseArgs, nil
+	}
+
+	iface := sessionIface(sessions, target)
+	if iface == "" {
+		var err error
+		if iface, err = iscsi.ifaceName(ctx, target.Iface); err != nil {
+			return nil, err
+		}
+	}
+
+	return append(baseArgs, "-I", iface), nil
+}
+
+// updateArgs returns the iscsiadm -n/-v pairs of the non-zero settings.
+func (cfg *NodeConfig) updateArgs() ([]string, error) {
+	var args []string
+	if cfg == nil {
+		return args, nil
+	}
+
+	set := func(key, value string) {
+		args = append(args, "-n", key, "-v", value)
+	}
+	setInt := func(key string, value int) {
+		if value > 0 {
+			set(key, strconv.Itoa(value))
+		}
+	}
+
+	if cfg.Startup != "" {
+		if !contains([]string{StartupManual, StartupAutomatic, StartupOnBoot}, cfg.Startup) {
+			return nil, fmt.Errorf("Invalid node startup: %s", cfg.Startup)
+		}
+		set(nodeStartupKey, cfg.Startup)
+		set(nodeConnStartupKey, cfg.Startup)
+	}
+	setInt(nodeReplacementTimeoutKey, cfg.ReplacementTimeout)
+	setInt(nodeNoopOutIntervalKey, cfg.NoopOutInterval)
+	setInt(nodeNoopOutTimeoutKey, cfg.NoopOutTimeout)
+	for _, digest := range [][2]string{{nodeHeaderDigestKey, cfg.HeaderDigest}, {nodeDataDigestKey, cfg.DataDigest}} {
+		if digest[1] == "" {
+			continue
+		}
+		if !contains([]string{"None", "CRC32C", "CRC32C,None", "None,CRC32C"}, digest[1]) {
+			return nil, fmt.Errorf("Invalid digest: %s", digest[1])
+		}
+		set(digest[0], digest[1])
+	}
+	setInt(nodeQueueDepthKey, cfg.QueueDepth)
+	setInt(nodeCmdsMaxKey, cfg.CmdsMax)
+
+	return args, nil
+}
+
+func nodeConfigFromRecord(record map[string]string) *NodeConfig {
+	atoi := func(key string) int {
+		value, _ := strconv.Atoi(record[key])
+		return value
+	}
+
+	return &NodeConfig{
+		Startup:            record[nodeStartupKey],
+		ReplacementTimeout: atoi(nodeReplacementTimeoutKey),
+		NoopOutInterval:    atoi(nodeNoopOutIntervalKey),
+		NoopOutTimeout:     atoi(nodeNoopOutTimeoutKey),
+		HeaderDigest:       record[nodeHeaderDigestKey],
+		DataDigest:         record[nodeDataDigestKey],
+		QueueDepth:         atoi(nodeQueueDepthKey),
+		CmdsMax:            atoi(nodeCmdsMaxKey),
+	}
+}
+
+func nodeFromRecord(record map[string]string) *Node {
+	portal := (&iscsiname.Portal{Host: record["node.conn[0].address"], Port: record["node.conn[0].port"]}).String()
+
+	return &Node{
+		Target:  record["node.name"],
+		Portal:  canonicalPortal(portal),
+		Iface:   record["iface.iscsi_ifacename"],
+		Startup: record[nodeStartupKey],
+		Config:  nodeConfigFromRecord(record),
+	}
+}
+
+// parseNodeRecords parses `iscsiadm -m node` record output of "key = value"
+// lines. Multiple records are separated by "# BEGIN RECORD" and "# END RECORD".
+func parseNodeRecords(out string) []map[string]string {
+	var records []map[string]string
+	var record map[string]string
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "# BEGIN RECORD"):
+			record = nil
+		case strings.HasPrefix(line, "# END RECORD"):
+			record = nil
+		case strings.HasPrefix(line, "#") || !strings.Contains(line, "="):
+			continue
+		default:
+			if record == nil {
+				record = make(map[string]string)
+				records = append(records, record)
+			}
+			key, value := fieldKeyValue(line, "=")
+			record[key] = value
+		}
+	}
+
+	return records
+}
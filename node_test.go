@@ -0,0 +1,96 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseNodeRecords(t *testing.T) {
+	out, err := os.ReadFile("testdata/node_record.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := parseNodeRecords(string(out))
+	if len(records) != 2 {
+		t.Fatalf("parseNodeRecords got %d records, expect 2", len(records))
+	}
+	if records[0]["iface.hwaddress"] != "" || records[1]["iface.iscsi_ifacename"] != "eth1-iface" {
+		t.Fatalf("unexpected records: %v", records)
+	}
+
+	cfg := nodeConfigFromRecord(records[0])
+	expect := &NodeConfig{
+		Startup:            "automatic",
+		ReplacementTimeout: 120,
+		NoopOutInterval:    5,
+		NoopOutTimeout:     5,
+		HeaderDigest:       "None",
+		DataDigest:         "None",
+		QueueDepth:         32,
+		CmdsMax:            128,
+	}
+	if !reflect.DeepEqual(cfg, expect) {
+		t.Fatalf("nodeConfigFromRecord got %+v, expect %+v", cfg, expect)
+	}
+}
+
+func TestNodeConfigUpdateArgs(t *testing.T) {
+	cfg := &NodeConfig{Startup: "onboot", ReplacementTimeout: 15, HeaderDigest: "CRC32C"}
+	args, err := cfg.updateArgs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{
+		"-n", "node.startup", "-v", "onboot",
+		"-n", "node.conn[0].startup", "-v", "onboot",
+		"-n", "node.session.timeo.replacement_timeout", "-v", "15",
+		"-n", "node.conn[0].iscsi.HeaderDigest", "-v", "CRC32C",
+	}
+	if !reflect.DeepEqual(args, expect) {
+		t.Fatalf("updateArgs got %v, expect %v", args, expect)
+	}
+
+	if args, err := (*NodeConfig)(nil).updateArgs(); err != nil || len(args) != 0 {
+		t.Fatalf("nil NodeConfig should have no args: %v, %v", args, err)
+	}
+	if _, err := (&NodeConfig{Startup: "always"}).updateArgs(); err == nil {
+		t.Fatalf("updateArgs should reject invalid startup")
+	}
+	if _, err := (&NodeConfig{DataDigest: "crc"}).updateArgs(); err == nil {
+		t.Fatalf("updateArgs should reject invalid digest")
+	}
+}
+
+func TestNodeFromRecord(t *testing.T) {
+	out, err := os.ReadFile("testdata/node_record.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := parseNodeRecords(string(out))
+	node := nodeFromRecord(records[1])
+	if node.Target != "iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr2" || node.Portal != "[fe80::1]:3260" ||
+		node.Iface != "eth1-iface" || node.Startup != StartupManual || node.Config.QueueDepth != 64 {
+		t.Fatalf("unexpected node: %+v", node)
+	}
+
+	if node = nodeFromRecord(records[0]); node.Portal != "192.168.206.50:3260" || node.Startup != StartupAutomatic {
+		t.Fatalf("unexpected node: %+v", node)
+	}
+}
+
+func TestTargetNodeConfig(t *testing.T) {
+	util := &ISCSIUtil{Opts: ISCSIOptions{NodeConfig: &NodeConfig{Startup: StartupManual, ReplacementTimeout: 15}}}
+
+	cfg := util.targetNodeConfig(&Target{Startup: StartupAutomatic})
+	if cfg.Startup != StartupAutomatic || cfg.ReplacementTimeout != 15 || util.Opts.NodeConfig.Startup != StartupManual {
+		t.Fatalf("unexpected node config: %+v", cfg)
+	}
+	if cfg = util.targetNodeConfig(&Target{}); cfg.Startup != StartupManual {
+		t.Fatalf("unexpected node config: %+v", cfg)
+	}
+}
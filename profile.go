@@ -0,0 +1,315 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/QsanJohnson/goiscsi/iscsiname"
+	"gopkg.in/yaml.v3"
+)
+
+type ProfileFormat string
+
+const (
+	ProfileINI  ProfileFormat = "ini"
+	ProfileYAML ProfileFormat = "yaml"
+	ProfileJSON ProfileFormat = "json"
+)
+
+// DefaultProfileVolume is the ID of the volume given by the INI keys before
+// the first section, as in test.conf.
+const DefaultProfileVolume = "default"
+
+// Profile is a set of named volumes loaded from a profile file.
+type Profile struct {
+	Volumes []*Volume
+}
+
+// INI profile keys. PORTALS, NODES and LUNS are comma separated lists of the
+// same length, one target per entry. NODES and LUNS may hold a single value
+// shared by all portals.
+const (
+	profilePortalsKey    = "PORTALS"
+	profileNodesKey      = "NODES"
+	profileLunsKey       = "LUNS"
+	profileChapUserKey   = "CHAP_USER"
+	profileChapPasswdKey = "CHAP_PASSWD"
+	profileIfaceKey      = "IFACE"
+	profileStartupKey    = "STARTUP"
+)
+
+// profileFile is the YAML and JSON profile layout.
+type profileFile struct {
+	Volumes []*profileVolume `json:"volumes" yaml:"volumes"`
+}
+
+type profileVolume struct {
+	ID      string           `json:"id" yaml:"id"`
+	Chap    *profileChap     `json:"chap,omitempty" yaml:"chap,omitempty"` // Default CHAP of targets
+	Targets []*profileTarget `json:"targets" yaml:"targets"`
+}
+
+type profileTarget struct {
+	Portal  string       `json:"portal" yaml:"portal"`
+	Name    string       `json:"name" yaml:"name"`
+	Lun     uint64       `json:"lun" yaml:"lun"`
+	Iface   string       `json:"iface,omitempty" yaml:"iface,omitempty"`
+	Startup string       `json:"startup,omitempty" yaml:"startup,omitempty"`
+	Chap    *profileChap `json:"chap,omitempty" yaml:"chap,omitempty"`
+}
+
+type profileChap struct {
+	User   string `json:"user" yaml:"user"`
+	Passwd string `json:"passwd" yaml:"passwd"`
+}
+
+// LoadProfile reads a profile file. The format follows the file extension,
+// .yaml or .yml for YAML, .json for JSON and INI otherwise.
+func LoadProfile(path string) (*Profile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read profile, err: %v", err)
+	}
+
+	format := ProfileINI
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		format = ProfileYAML
+	case ".json":
+		format = ProfileJSON
+	}
+
+	profile, err := ParseProfile(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid profile %s, err: %v", path, err)
+	}
+	return profile, nil
+}
+
+// ParseProfile parses and validates a profile. Portals without port get the
+// default port 3260.
+func ParseProfile(data []byte, format ProfileFormat) (*Profile, error) {
+	var profile *Profile
+	var err error
+	switch format {
+	case ProfileINI:
+		profile, err = parseINIProfile(data)
+	case ProfileYAML, ProfileJSON:
+		file := &profileFile{}
+		if format == ProfileYAML {
+			err = yaml.Unmarshal(data, file)
+		} else {
+			err = json.Unmarshal(data, file)
+		}
+		if err == nil {
+			profile = file.profile()
+		}
+	default:
+		return nil, fmt.Errorf("Unknown profile format: %s", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := profile.validate(); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// Volume returns the volume of id, or nil if not found.
+func (p *Profile) Volume(id string) *Volume {
+	for _, vol := range p.Volumes {
+		if vol.ID == id {
+			return vol
+		}
+	}
+
+	return nil
+}
+
+// Targets returns the targets of the volume id, or nil if not found.
+func (p *Profile) Targets(id string) []*Target {
+	if vol := p.Volume(id); vol != nil {
+		return vol.Targets
+	}
+
+	return nil
+}
+
+func (p *Profile) validate() error {
+	if len(p.Volumes) == 0 {
+		return fmt.Errorf("No volume")
+	}
+
+	seen := make(map[string]bool)
+	for _, vol := range p.Volumes {
+		if vol.ID == "" {
+			return fmt.Errorf("Volume without id")
+		}
+		if seen[vol.ID] {
+			return fmt.Errorf("Duplicate volume %s", vol.ID)
+		}
+		seen[vol.ID] = true
+
+		if len(vol.Targets) == 0 {
+			return fmt.Errorf("Volume %s has no target", vol.ID)
+		}
+		if err := validateTargets(vol.Targets); err != nil {
+			return fmt.Errorf("Volume %s: %v", vol.ID, err)
+		}
+		for _, target := range vol.Targets {
+			if target.Startup != "" && !contains([]string{StartupManual, StartupAutomatic, StartupOnBoot}, target.Startup) {
+				return fmt.Errorf("Volume %s: Invalid node startup: %s", vol.ID, target.Startup)
+			}
+			if target.Chap != nil && (target.Chap.User == "" || target.Chap.Passwd == "") {
+				return fmt.Errorf("Volume %s: CHAP user and password are both required", vol.ID)
+			}
+			p, _ := iscsiname.ParsePortal(target.Portal)
+			target.Portal = p.String()
+		}
+	}
+
+	return nil
+}
+
+func (file *profileFile) profile() *Profile {
+	profile := &Profile{}
+	for _, v := range file.Volumes {
+		vol := &Volume{ID: v.ID}
+		for _, t := range v.Targets {
+			target := &Target{Portal: t.Portal, Name: t.Name, Lun: t.Lun, Iface: t.Iface, Startup: t.Startup}
+			chap := t.Chap
+			if chap == nil {
+				chap = v.Chap
+			}
+			if chap != nil {
+				target.Chap = &Chap{User: chap.User, Passwd: chap.Passwd}
+			}
+			vol.Targets = append(vol.Targets, target)
+		}
+		profile.Volumes = append(profile.Volumes, vol)
+	}
+
+	return profile
+}
+
+// parseINIProfile parses "KEY = value" lines as in test.conf. Keys before the
+// first [name] section form the DefaultProfileVolume, each section a volume
+// of that name. Lines starting with # or ; are comments.
+func parseINIProfile(data []byte) (*Profile, error) {
+	var ids []string
+	sections := make(map[string]map[string]string)
+	id := DefaultProfileVolume
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";"):
+			continue
+		case strings.HasPrefix(line, "["):
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("Line %d: invalid section %s", n, line)
+			}
+			id = strings.TrimSpace(line[1 : len(line)-1])
+			if _, ok := sections[id]; ok {
+				return nil, fmt.Errorf("Line %d: duplicate volume %s", n, id)
+			}
+			sections[id] = make(map[string]string)
+			ids = append(ids, id)
+			continue
+		case !strings.Contains(line, "="):
+			return nil, fmt.Errorf("Line %d: expect KEY = value", n)
+		}
+
+		if _, ok := sections[id]; !ok {
+			sections[id] = make(map[string]string)
+			ids = append(ids, id)
+		}
+		key, value := fieldKeyValue(line, "=")
+		sections[id][strings.ToUpper(key)] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	profile := &Profile{}
+	for _, id := range ids {
+		vol, err := iniVolume(id, sections[id])
+		if err != nil {
+			return nil, err
+		}
+		profile.Volumes = append(profile.Volumes, vol)
+	}
+
+	return profile, nil
+}
+
+func iniVolume(id string, keys map[string]string) (*Volume, error) {
+	portals := splitProfileList(keys[profilePortalsKey])
+	nodes := splitProfileList(keys[profileNodesKey])
+	luns := splitProfileList(keys[profileLunsKey])
+	if len(portals) == 0 || len(nodes) == 0 || len(luns) == 0 {
+		return nil, fmt.Errorf("Volume %s: %s, %s and %s are required", id, profilePortalsKey, profileNodesKey, profileLunsKey)
+	}
+	for _, list := range []struct {
+		key    string
+		values []string
+	}{{profileNodesKey, nodes}, {profileLunsKey, luns}} {
+		if len(list.values) != 1 && len(list.values) != len(portals) {
+			return nil, fmt.Errorf("Volume %s: the number of %s and %s should be the same", id, profilePortalsKey, list.key)
+		}
+	}
+
+	// As in test.conf, CHAP is only used when both keys are set
+	var chap *Chap
+	if keys[profileChapUserKey] != "" && keys[profileChapPasswdKey] != "" {
+		chap = &Chap{User: keys[profileChapUserKey], Passwd: keys[profileChapPasswdKey]}
+	} else if keys[profileChapUserKey] != "" || keys[profileChapPasswdKey] != "" {
+		defaultLogger.Info("Ignore incomplete CHAP, CHAP_USER and CHAP_PASSWD are both required", "volume", id)
+	}
+
+	vol := &Volume{ID: id}
+	for i, portal := range portals {
+		target := &Target{
+			Portal:  portal,
+			Name:    nodes[0],
+			Chap:    chap,
+			Iface:   keys[profileIfaceKey],
+			Startup: keys[profileStartupKey],
+		}
+		if len(nodes) > 1 {
+			target.Name = nodes[i]
+		}
+		lun := luns[0]
+		if len(luns) > 1 {
+			lun = luns[i]
+		}
+		var err error
+		if target.Lun, err = strconv.ParseUint(lun, 10, 64); err != nil {
+			return nil, fmt.Errorf("Volume %s: invalid LUN %s", id, lun)
+		}
+		vol.Targets = append(vol.Targets, target)
+	}
+
+	return vol, nil
+}
+
+func splitProfileList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
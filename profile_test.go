@@ -0,0 +1,85 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLoadProfile(t *testing.T) {
+	chap := &Chap{User: "johnson", Passwd: "111122223333"}
+	expected := []*Volume{
+		{ID: DefaultProfileVolume, Targets: []*Target{
+			{Portal: "192.168.206.50:3260", Name: "iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr1", Lun: 0, Chap: chap},
+			{Portal: "192.168.206.51:3261", Name: "iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr2", Lun: 0, Chap: chap},
+		}},
+		{ID: "db-data", Targets: []*Target{
+			{Portal: "[fe80::1]:3260", Name: "iqn.2004-08.com.qsan:xf2026-000d42f58:dev4", Lun: 7, Iface: "eth1-iface", Startup: StartupAutomatic},
+			{Portal: "[fe80::2]:3260", Name: "iqn.2004-08.com.qsan:xf2026-000d42f58:dev4", Lun: 7, Iface: "eth1-iface", Startup: StartupAutomatic},
+		}},
+	}
+
+	for _, path := range []string{"testdata/profile.conf", "testdata/profile.yaml", "testdata/profile.json"} {
+		profile, err := LoadProfile(path)
+		if err != nil {
+			t.Fatalf("LoadProfile(%s) failed: %v", path, err)
+		}
+		if !reflect.DeepEqual(profile.Volumes, expected) {
+			for _, vol := range profile.Volumes {
+				for _, target := range vol.Targets {
+					t.Logf("%s: %+v", vol.ID, target)
+				}
+			}
+			t.Errorf("LoadProfile(%s) got unexpected volumes", path)
+		}
+		if len(profile.Targets("db-data")) != 2 || profile.Targets("none") != nil {
+			t.Errorf("Targets of %s got unexpected targets", path)
+		}
+	}
+}
+
+func TestParseProfileIncompleteChap(t *testing.T) {
+	// Incomplete CHAP is ignored in INI profiles as in test.conf
+	for _, key := range []string{"CHAP_USER = johnson", "CHAP_PASSWD = 111122223333"} {
+		profile, err := ParseProfile([]byte("PORTALS = 192.168.206.50\nNODES = iqn.2004-08.com.qsan:a\nLUNS = 0\n"+key), ProfileINI)
+		if err != nil {
+			t.Fatalf("ParseProfile with %s failed: %v", key, err)
+		}
+		if chap := profile.Volumes[0].Targets[0].Chap; chap != nil {
+			t.Errorf("ParseProfile with %s got CHAP %+v, expect none", key, chap)
+		}
+	}
+
+	// YAML and JSON profiles still require both
+	if _, err := ParseProfile([]byte("volumes:\n- id: a\n  chap: {user: johnson}\n  targets: [{portal: 192.168.206.50, name: 'iqn.2004-08.com.qsan:a'}]"), ProfileYAML); err == nil {
+		t.Errorf("ParseProfile of YAML with partial CHAP expect error")
+	}
+}
+
+func TestParseProfileInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		format ProfileFormat
+		data   string
+	}{
+		{"count mismatch", ProfileINI, "PORTALS = 192.168.206.50,192.168.206.51\nNODES = iqn.2004-08.com.qsan:a,iqn.2004-08.com.qsan:b,iqn.2004-08.com.qsan:c\nLUNS = 0"},
+		{"missing nodes", ProfileINI, "PORTALS = 192.168.206.50\nLUNS = 0"},
+		{"invalid lun", ProfileINI, "PORTALS = 192.168.206.50\nNODES = iqn.2004-08.com.qsan:a\nLUNS = x"},
+		{"invalid portal", ProfileINI, "PORTALS = 192.168.206.50:99999\nNODES = iqn.2004-08.com.qsan:a\nLUNS = 0"},
+		{"invalid name", ProfileINI, "PORTALS = 192.168.206.50\nNODES = qsan\nLUNS = 0"},
+		{"invalid startup", ProfileINI, "PORTALS = 192.168.206.50\nNODES = iqn.2004-08.com.qsan:a\nLUNS = 0\nSTARTUP = always"},
+		{"duplicate section", ProfileINI, "[a]\nPORTALS = 192.168.206.50\nNODES = iqn.2004-08.com.qsan:a\nLUNS = 0\n[a]\n"},
+		{"bad line", ProfileINI, "PORTALS 192.168.206.50"},
+		{"empty", ProfileINI, "# nothing"},
+		{"duplicate volume", ProfileYAML, "volumes:\n- id: a\n  targets: [{portal: 192.168.206.50, name: 'iqn.2004-08.com.qsan:a'}]\n- id: a\n  targets: [{portal: 192.168.206.50, name: 'iqn.2004-08.com.qsan:a'}]"},
+		{"no target", ProfileJSON, `{"volumes": [{"id": "a"}]}`},
+		{"no id", ProfileJSON, `{"volumes": [{"targets": [{"portal": "192.168.206.50", "name": "iqn.2004-08.com.qsan:a"}]}]}`},
+	}
+
+	for _, tt := range tests {
+		if _, err := ParseProfile([]byte(tt.data), tt.format); err == nil {
+			t.Errorf("ParseProfile(%s) expect error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"context"
+	"fmt"
+)
+
+type ReconcileOptions struct {
+	DryRun bool // Only plan the actions without running them
+	// LogoutUnexpected logs out sessions of targets that are not desired.
+	// Only sessions for which IsManaged returns true are logged out, so that
+	// sessions created by other tools are left alone. IsManaged is required
+	// when LogoutUnexpected is set.
+	LogoutUnexpected bool
+	IsManaged        func(sess *Session) bool
+}
+
+// ReconcileAction is a planned action of Reconcile. Err is the result of
+// the action, it is always nil in dry-run mode.
+type ReconcileAction struct {
+	Target  *Target
+	Session *Session
+	Err     error
+
+	resolved *Target // Target with resolved portal and default iface applied
+}
+
+type ReconcileResult struct {
+	DryRun bool
+	Login  []*ReconcileAction // Desired targets with fewer sessions than NrSessions
+	Rescan []*ReconcileAction // Sessions of desired targets missing the LUN, one per session
+	Logout []*ReconcileAction // Managed sessions of targets that are not desired
+	InSync []*Target          // Desired targets whose sessions and LUN exist
+}
+
+// Reconcile compares the desired targets with the current sessions and logs
+// in missing targets or their missing sessions up to NrSessions, rescans sessions missing the target LUN and, if enabled,
+// logs out unexpected managed sessions. It returns the planned actions and their
+// results. An error is returned if the context is done or any action failed.
+func (iscsi *ISCSIUtil) Reconcile(ctx context.Context, desired []*Target, opts *ReconcileOptions) (_ *ReconcileResult, err error) {
+	ctx, span := iscsi.startSpan(ctx, "Reconcile", targetsAttrs(desired)...)
+	defer endSpan(span, &err)
+
+	if err := validateTargets(desired); err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &ReconcileOptions{}
+	}
+	if opts.LogoutUnexpected && opts.IsManaged == nil {
+		return nil, fmt.Errorf("ReconcileOptions.IsManaged is required by LogoutUnexpected")
+	}
+
+	sessions := iscsi.sessions(ctx, false)
+	resolved := iscsi.resolveTargets(ctx, sessions, desired)
+	result := planReconcile(sessions, desired, resolved, iscsi.nrSessions(), opts)
+	iscsi.logger().V(1).Info("Reconcile", "dryRun", opts.DryRun, "loginCnt", len(result.Login),
+		"rescanCnt", len(result.Rescan), "logoutCnt", len(result.Logout), "inSyncCnt", len(result.InSync))
+	if opts.DryRun {
+		return result, nil
+	}
+
+	failed := 0
+	for _, action := range result.Login {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		if _, action.Err = iscsi.loginTarget(ctx, action.resolved); action.Err != nil {
+			failed++
+		}
+	}
+
+	for _, action := range result.Rescan {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		if action.Err = iscsi.rescanSessionByID(ctx, action.Session.SID); action.Err != nil {
+			failed++
+		}
+		iscsi.InvalidateSessionCache()
+	}
+
+	for _, action := range result.Logout {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		if action.Err = iscsi.logoutTarget(ctx, action.resolved); action.Err != nil {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return result, fmt.Errorf("Reconcile failed, %d actions failed", failed)
+	}
+	return result, nil
+}
+
+// planReconcile computes the Reconcile actions. desired and resolved are the
+// caller targets and their resolved copies in the same order, nrSessions the
+// expected number of sessions per target.
+func planReconcile(sessions []*Session, desired, resolved []*Target, nrSessions int, opts *ReconcileOptions) *ReconcileResult {
+	result := &ReconcileResult{DryRun: opts.DryRun}
+	for i, target := range resolved {
+		cnt, _ := targetSessionCount(sessions, target)
+		inSync := true
+		if cnt < nrSessions {
+			// loginTarget logs in the missing sessions of a target with sessions
+			result.Login = append(result.Login, &ReconcileAction{Target: desired[i], resolved: target})
+			inSync = false
+		}
+		if cnt > 0 && !lunSessionExists(sessions, target) {
+			// Every session of the target reaches the LUN once rescanned
+			for _, sess := range sessions {
+				if sessionOfTarget(sess, target) {
+					result.Rescan = append(result.Rescan, &ReconcileAction{Target: desired[i], Session: sess})
+				}
+			}
+			inSync = false
+		}
+		if inSync {
+			result.InSync = append(result.InSync, desired[i])
+		}
+	}
+
+	if !opts.LogoutUnexpected || opts.IsManaged == nil {
+		return result
+	}
+
+	loggedOut := make(map[string]bool)
+	for _, sess := range sessions {
+		expected := false
+		for _, target := range resolved {
+			if sess.Portal == canonicalPortal(target.Portal) && sess.Target == target.Name && sessionIfaceMatches(sess, target.Iface) {
+				expected = true
+				break
+			}
+		}
+
+		// Sessions of the same node record are logged out together
+		key := sess.Portal + "," + sess.Target + "," + sess.Iface
+		if !expected && !loggedOut[key] && opts.IsManaged(sess) {
+			loggedOut[key] = true
+			target := &Target{Portal: sess.Portal, Name: sess.Target, Iface: sess.Iface}
+			result.Logout = append(result.Logout, &ReconcileAction{Target: target, Session: sess, resolved: target})
+		}
+	}
+
+	return result
+}
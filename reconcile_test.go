@@ -0,0 +1,80 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPlanReconcile(t *testing.T) {
+	out, err := os.ReadFile("testdata/session_p3.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := parseSessions(string(out))
+
+	desired := []*Target{
+		{Portal: "192.168.206.50", Name: "iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr1", Lun: 1},
+		{Portal: "192.168.206.50", Name: "iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr1", Lun: 2, Iface: "eth1-iface"},
+		{Portal: "192.168.206.51", Name: "iqn.2004-08.com.qsan:xf2026-000d42f58:dev4.ctr1", Lun: 0},
+	}
+	util := &ISCSIUtil{}
+	resolved := util.resolveTargets(context.Background(), sessions, desired)
+
+	opts := &ReconcileOptions{
+		DryRun:           true,
+		LogoutUnexpected: true,
+		IsManaged: func(sess *Session) bool {
+			return strings.HasPrefix(sess.Target, "iqn.2004-08.com.qsan:")
+		},
+	}
+	result := planReconcile(sessions, desired, resolved, 1, opts)
+
+	if len(result.InSync) != 1 || result.InSync[0] != desired[0] {
+		t.Errorf("unexpected InSync: %+v", result.InSync)
+	}
+	if len(result.Rescan) != 1 || result.Rescan[0].Target != desired[1] || result.Rescan[0].Session.SID != 2 {
+		t.Errorf("unexpected Rescan: %+v", result.Rescan)
+	}
+	if len(result.Login) != 1 || result.Login[0].Target != desired[2] {
+		t.Errorf("unexpected Login: %+v", result.Login)
+	}
+	if len(result.Logout) != 1 || result.Logout[0].Session.SID != 3 {
+		t.Errorf("unexpected Logout: %+v", result.Logout)
+	}
+
+	// Every session of a multi-session target missing the LUN is rescanned
+	multi := []*Target{{Portal: "192.168.206.50", Name: "iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr1", Lun: 5}}
+	result = planReconcile(sessions, multi, util.resolveTargets(context.Background(), sessions, multi), 1, opts)
+	if len(result.Rescan) != 2 || result.Rescan[0].Session.SID != 1 || result.Rescan[1].Session.SID != 2 {
+		t.Errorf("unexpected multi-session Rescan: %+v", result.Rescan)
+	}
+
+	// With two sessions per target, the single eth1-iface session is topped up
+	result = planReconcile(sessions, desired, resolved, 2, opts)
+	if len(result.InSync) != 1 || result.InSync[0] != desired[0] {
+		t.Errorf("unexpected InSync with 2 sessions: %+v", result.InSync)
+	}
+	if len(result.Login) != 2 || result.Login[0].Target != desired[1] || result.Login[1].Target != desired[2] {
+		t.Errorf("unexpected Login with 2 sessions: %+v", result.Login)
+	}
+	if len(result.Rescan) != 1 || result.Rescan[0].Session.SID != 2 {
+		t.Errorf("unexpected Rescan with 2 sessions: %+v", result.Rescan)
+	}
+
+	opts.IsManaged = func(sess *Session) bool { return false }
+	if result = planReconcile(sessions, desired, resolved, 1, opts); len(result.Logout) != 0 {
+		t.Errorf("unmanaged sessions should not be logged out: %+v", result.Logout)
+	}
+}
+
+func TestReconcileRequiresIsManaged(t *testing.T) {
+	util := &ISCSIUtil{}
+	desired := []*Target{{Portal: "192.168.206.50", Name: "iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr1"}}
+	if _, err := util.Reconcile(context.Background(), desired, &ReconcileOptions{LogoutUnexpected: true}); err == nil {
+		t.Errorf("Reconcile should fail with LogoutUnexpected and no IsManaged")
+	}
+}
@@ -0,0 +1,111 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/QsanJohnson/goiscsi/iscsiname"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Resolver looks up the IP addresses of a portal host name. *net.Resolver
+// satisfies this interface.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+const resolveTimeout = 5000 // Millisecond
+
+// resolveTargets returns copies of targets whose portal host names are resolved
+// to IP addresses, so that they can be passed to iscsiadm and compared with the
+// session portals it reports. When a name resolves to several addresses, the one
+// with an existing session is preferred. The original portal is kept in the copy
+// for reporting. Targets that fail to resolve keep their portal. ISCSIOptions.Iface
+// is applied to targets without iface. Lookups are bounded by the deadline of ctx.
+func (iscsi *ISCSIUtil) resolveTargets(ctx context.Context, sessions []*Session, targets []*Target) []*Target {
+	resolved := make([]*Target, 0, len(targets))
+	for _, target := range targets {
+		t := *target
+		if t.Iface == "" {
+			t.Iface = iscsi.Opts.Iface
+		}
+
+		p, err := iscsiname.ParsePortal(target.Portal)
+		if err != nil || p.IsIP() {
+			resolved = append(resolved, &t)
+			continue
+		}
+
+		addrs, err := iscsi.lookupHost(ctx, p.Host)
+		if err != nil || len(addrs) == 0 {
+			iscsi.logger().Info("Failed to resolve portal", "portal", target.Portal, "err", err)
+			resolved = append(resolved, &t)
+			continue
+		}
+
+		t.portalName = target.Portal
+		t.Portal = (&iscsiname.Portal{Host: addrs[0], Port: p.Port}).String()
+		for _, addr := range addrs {
+			portal := (&iscsiname.Portal{Host: addr, Port: p.Port}).String()
+			if targetSessionExists(sessions, &Target{Portal: portal, Name: t.Name, Iface: t.Iface}) {
+				t.Portal = portal
+				break
+			}
+		}
+		iscsi.logger().V(2).Info("Resolved portal", "portal", t.portalName, "address", t.Portal, "addresses", addrs)
+		resolved = append(resolved, &t)
+	}
+
+	return resolved
+}
+
+// portalAddresses returns portal in canonical form, or the portals of all the
+// addresses of its host name. Portals failing to resolve are returned as is.
+func (iscsi *ISCSIUtil) portalAddresses(ctx context.Context, portal string) []string {
+	p, err := iscsiname.ParsePortal(portal)
+	if err != nil || p.IsIP() {
+		return []string{canonicalPortal(portal)}
+	}
+
+	addrs, err := iscsi.lookupHost(ctx, p.Host)
+	if err != nil || len(addrs) == 0 {
+		iscsi.logger().Info("Failed to resolve portal", "portal", portal, "err", err)
+		return []string{canonicalPortal(portal)}
+	}
+
+	portals := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		portals = append(portals, (&iscsiname.Portal{Host: addr, Port: p.Port}).String())
+	}
+	return portals
+}
+
+// lookupHost resolves host within resolveTimeout and the deadline of ctx.
+func (iscsi *ISCSIUtil) lookupHost(ctx context.Context, host string) (_ []string, err error) {
+	ctx, span := iscsi.startSpan(ctx, "lookupHost", attribute.String("net.host", host))
+	defer endSpan(span, &err)
+
+	resolver := iscsi.Opts.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout*time.Millisecond)
+	defer cancel()
+	addrs, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	// Normalize addresses so that they compare equal to session portals
+	for i, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			addrs[i] = ip.String()
+		}
+	}
+
+	return addrs, nil
+}
@@ -0,0 +1,307 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// Attachment records a volume attached by goiscsi, so that it can be detached
+// after a crash without the caller reconstructing its targets. CHAP passwords
+// are not stored.
+type Attachment struct {
+	ID        string    `json:"id"`
+	Targets   []*Target `json:"targets"`
+	WWID      string    `json:"wwid,omitempty"`
+	DMName    string    `json:"dmName,omitempty"`
+	Mounts    []string  `json:"mounts,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Store keeps attachments as JSON files under a directory, one file per
+// attachment. Writes are atomic and serialized across processes by a lock file.
+type Store struct {
+	Logger logr.Logger // Structured logger, default is klog
+
+	dir string
+}
+
+const (
+	storeFileExt  = ".json"
+	storeLockFile = ".lock"
+	dmUUIDPrefix  = "mpath-"
+)
+
+// sysBlockDir is the sysfs directory of block devices, replaced in tests.
+var sysBlockDir = "/sys/block"
+
+func NewStore(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Failed to create store dir, err: %v", err)
+	}
+
+	return &Store{dir: dir}, nil
+}
+
+// NewAttachment returns an attachment of targets with the WWID, multipath
+// device name and mount points of their disk. The WWID is the one of the
+// multipath map, or the disk serial without multipath.
+func (iscsi *ISCSIUtil) NewAttachment(id string, targets []*Target) (*Attachment, error) {
+	disk, err := iscsi.GetDisk(targets)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Attachment{ID: id, Targets: targets, WWID: disk.Serial}
+	if dev, ok := disk.Devices[disk.Name]; ok {
+		if dev.Type == "mpath" {
+			a.DMName = dev.Name
+			if wwid, err := dmWWID(disk.Name); err == nil {
+				a.WWID = wwid
+			} else {
+				iscsi.logger().Info("Failed to get multipath WWID", "device", disk.Name, "err", err)
+			}
+		}
+		a.Mounts = iscsi.getMountPoints(context.Background(), "/dev/"+disk.Name)
+	}
+
+	return a, nil
+}
+
+// Save creates or replaces the attachment with the same ID.
+func (s *Store) Save(a *Attachment) error {
+	if a.ID == "" {
+		return fmt.Errorf("Attachment ID is empty")
+	}
+	if strings.HasPrefix(a.ID, ".") {
+		// Dot files are the lock and temporary files of the store
+		return fmt.Errorf("Attachment ID %s starts with a dot", a.ID)
+	}
+
+	lock, err := lockFile(filepath.Join(s.dir, storeLockFile), true)
+	if err != nil {
+		return err
+	}
+	defer unlockFile(lock)
+
+	rec := *a
+	rec.Targets = make([]*Target, 0, len(a.Targets))
+	for _, target := range a.Targets {
+		t := *target
+		if t.portalName != "" {
+			t.Portal = t.portalName
+		}
+		if t.Chap != nil {
+			t.Chap = &Chap{User: t.Chap.User}
+		}
+		rec.Targets = append(rec.Targets, &t)
+	}
+
+	now := time.Now()
+	if old, err := s.load(a.ID); err == nil {
+		rec.CreatedAt = old.CreatedAt
+	} else if rec.CreatedAt.IsZero() {
+		rec.CreatedAt = now
+	}
+	rec.UpdatedAt = now
+
+	data, err := json.MarshalIndent(&rec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to encode attachment %s, err: %v", a.ID, err)
+	}
+	if err := writeFileAtomic(s.path(a.ID), data, 0600); err != nil {
+		return fmt.Errorf("Failed to save attachment %s, err: %v", a.ID, err)
+	}
+	s.logger().V(2).Info("Save attachment", "id", a.ID)
+
+	return nil
+}
+
+func (s *Store) Load(id string) (*Attachment, error) {
+	lock, err := lockFile(filepath.Join(s.dir, storeLockFile), false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockFile(lock)
+
+	return s.load(id)
+}
+
+// List returns all attachments sorted by ID.
+func (s *Store) List() ([]*Attachment, error) {
+	lock, err := lockFile(filepath.Join(s.dir, storeLockFile), false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockFile(lock)
+
+	return s.list()
+}
+
+func (s *Store) Delete(id string) error {
+	lock, err := lockFile(filepath.Join(s.dir, storeLockFile), true)
+	if err != nil {
+		return err
+	}
+	defer unlockFile(lock)
+
+	if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to delete attachment %s, err: %v", id, err)
+	}
+
+	return nil
+}
+
+// GC deletes the attachments for which stale returns true, as well as temporary
+// files left by interrupted writes, and returns the deleted attachments.
+func (s *Store) GC(stale func(a *Attachment) bool) ([]*Attachment, error) {
+	lock, err := lockFile(filepath.Join(s.dir, storeLockFile), true)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockFile(lock)
+
+	if tmps, err := filepath.Glob(filepath.Join(s.dir, ".*"+storeFileExt+".tmp*")); err == nil {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+	}
+
+	attachments, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []*Attachment
+	for _, a := range attachments {
+		if !stale(a) {
+			continue
+		}
+		if err := os.Remove(s.path(a.ID)); err != nil && !os.IsNotExist(err) {
+			return deleted, fmt.Errorf("Failed to delete attachment %s, err: %v", a.ID, err)
+		}
+		s.logger().V(2).Info("GC attachment", "id", a.ID)
+		deleted = append(deleted, a)
+	}
+
+	return deleted, nil
+}
+
+// IsManaged lists the stored attachments once and returns a function reporting
+// whether a session belongs to one of their targets, matching its portal and
+// iface as well as its IQN. Host name portals are resolved by iscsi to all
+// their addresses. The function can be used as ReconcileOptions.IsManaged.
+func (s *Store) IsManaged(ctx context.Context, iscsi *ISCSIUtil) (func(sess *Session) bool, error) {
+	attachments, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	type managedTarget struct {
+		portals map[string]bool
+		name    string
+		iface   string
+	}
+	var managed []*managedTarget
+	for _, a := range attachments {
+		for _, target := range a.Targets {
+			m := &managedTarget{portals: make(map[string]bool), name: target.Name, iface: target.Iface}
+			if m.iface == "" {
+				m.iface = iscsi.Opts.Iface
+			}
+			for _, portal := range iscsi.portalAddresses(ctx, target.Portal) {
+				m.portals[portal] = true
+			}
+			managed = append(managed, m)
+		}
+	}
+
+	return func(sess *Session) bool {
+		for _, m := range managed {
+			if m.portals[sess.Portal] && sess.Target == m.name && sessionIfaceMatches(sess, m.iface) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// dmWWID returns the WWID of the multipath map of the dm device name, e.g.
+// dm-0, from its "mpath-<wwid>" dm uuid.
+func dmWWID(name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(sysBlockDir, name, "dm", "uuid"))
+	if err != nil {
+		return "", err
+	}
+
+	uuid := strings.TrimSpace(string(data))
+	if !strings.HasPrefix(uuid, dmUUIDPrefix) {
+		return "", fmt.Errorf("%s is not a multipath map, dm uuid: %s", name, uuid)
+	}
+	return strings.TrimPrefix(uuid, dmUUIDPrefix), nil
+}
+
+func (s *Store) logger() logr.Logger {
+	if s.Logger.GetSink() == nil {
+		return defaultLogger
+	}
+	return s.Logger
+}
+
+func (s *Store) path(id string) string {
+	return filepath.Join(s.dir, url.PathEscape(id)+storeFileExt)
+}
+
+func (s *Store) load(id string) (*Attachment, error) {
+	data, err := os.ReadFile(s.path(id))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load attachment %s, err: %v", id, err)
+	}
+
+	a := &Attachment{}
+	if err := json.Unmarshal(data, a); err != nil {
+		return nil, fmt.Errorf("Failed to decode attachment %s, err: %v", id, err)
+	}
+
+	return a, nil
+}
+
+func (s *Store) list() ([]*Attachment, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read store dir, err: %v", err)
+	}
+
+	var attachments []*Attachment
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, storeFileExt) {
+			continue
+		}
+
+		id, err := url.PathUnescape(strings.TrimSuffix(name, storeFileExt))
+		if err != nil {
+			continue
+		}
+		a, err := s.load(id)
+		if err != nil {
+			s.logger().Info("Skip attachment file", "file", name, "err", err)
+			continue
+		}
+		attachments = append(attachments, a)
+	}
+
+	sort.Slice(attachments, func(i, j int) bool { return attachments[i].ID < attachments[j].ID })
+	return attachments, nil
+}
@@ -0,0 +1,175 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &Attachment{
+		ID: "pvc-1/vol",
+		Targets: []*Target{
+			{Portal: "192.168.206.50:3260", Name: "iqn.2004-08.com.qsan:dev3.ctr1", Lun: 1, Chap: &Chap{User: "johnson", Passwd: "111122223333"}},
+		},
+		WWID:   "0x6001405abcdef",
+		DMName: "mpatha",
+	}
+	if err := store.Save(a); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if err := store.Save(&Attachment{ID: "pvc-2"}); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	loaded, err := store.Load("pvc-1/vol")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if loaded.WWID != a.WWID || loaded.DMName != a.DMName || len(loaded.Targets) != 1 || loaded.CreatedAt.IsZero() {
+		t.Fatalf("unexpected attachment: %+v", loaded)
+	}
+	if loaded.Targets[0].Chap.User != "johnson" || loaded.Targets[0].Chap.Passwd != "" || a.Targets[0].Chap.Passwd == "" {
+		t.Fatalf("CHAP password should be stripped from stored copy only: %+v", loaded.Targets[0].Chap)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(dir, "pvc-1%2Fvol.json"))
+	if strings.Contains(string(data), "111122223333") {
+		t.Fatalf("CHAP password is stored:\n%s", data)
+	}
+
+	managed := []struct {
+		sess *Session
+		want bool
+	}{
+		{&Session{Portal: "192.168.206.50:3260", Target: "iqn.2004-08.com.qsan:dev3.ctr1"}, true},
+		{&Session{Portal: "192.168.206.51:3260", Target: "iqn.2004-08.com.qsan:dev3.ctr1"}, false},
+		{&Session{Portal: "192.168.206.50:3260", Target: "iqn.2004-08.com.qsan:dev4"}, false},
+	}
+	isManaged, err := store.IsManaged(context.Background(), &ISCSIUtil{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range managed {
+		if got := isManaged(m.sess); got != m.want {
+			t.Fatalf("IsManaged(%s %s) got %v, expect %v", m.sess.Portal, m.sess.Target, got, m.want)
+		}
+	}
+
+	if err := store.Save(&Attachment{ID: ".vol"}); err == nil {
+		t.Fatalf("Save should reject IDs starting with a dot")
+	}
+
+	os.WriteFile(filepath.Join(dir, ".pvc-3.json.tmp123"), []byte("{"), 0600)
+	deleted, err := store.GC(func(a *Attachment) bool { return len(a.Targets) == 0 })
+	if err != nil || len(deleted) != 1 || deleted[0].ID != "pvc-2" {
+		t.Fatalf("GC got %v, err: %v", deleted, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".pvc-3.json.tmp123")); !os.IsNotExist(err) {
+		t.Fatalf("GC should remove temporary files")
+	}
+
+	list, err := store.List()
+	if err != nil || len(list) != 1 || list[0].ID != "pvc-1/vol" {
+		t.Fatalf("List got %v, err: %v", list, err)
+	}
+
+	if err := store.Delete("pvc-1/vol"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if list, _ = store.List(); len(list) != 0 {
+		t.Fatalf("List after Delete got %v", list)
+	}
+}
+
+func TestStoreLegacyRecord(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Record saved before Target had JSON tags
+	legacy := `{
+  "id": "pvc-1",
+  "targets": [
+    {"Portal": "192.168.206.50:3260", "Name": "iqn.2004-08.com.qsan:dev3.ctr1", "Lun": 1, "Chap": {"User": "johnson", "Passwd": ""}, "Iface": "", "Startup": "automatic"}
+  ],
+  "createdAt": "2022-10-18T10:00:00Z",
+  "updatedAt": "2022-10-18T10:00:00Z"
+}`
+	if err := os.WriteFile(filepath.Join(dir, "pvc-1.json"), []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := store.Load("pvc-1")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	target := a.Targets[0]
+	if target.Portal != "192.168.206.50:3260" || target.Name != "iqn.2004-08.com.qsan:dev3.ctr1" || target.Lun != 1 ||
+		target.Chap == nil || target.Chap.User != "johnson" || target.Startup != StartupAutomatic {
+		t.Fatalf("unexpected legacy target: %+v", target)
+	}
+}
+
+func TestDMWWID(t *testing.T) {
+	dir := t.TempDir()
+	defer func(old string) { sysBlockDir = old }(sysBlockDir)
+	sysBlockDir = dir
+
+	for name, uuid := range map[string]string{"dm-0": "mpath-36001405abcdef\n", "dm-1": "LVM-xyz\n"} {
+		os.MkdirAll(filepath.Join(dir, name, "dm"), 0755)
+		os.WriteFile(filepath.Join(dir, name, "dm", "uuid"), []byte(uuid), 0644)
+	}
+
+	if wwid, err := dmWWID("dm-0"); err != nil || wwid != "36001405abcdef" {
+		t.Fatalf("dmWWID(dm-0) got %q, err: %v", wwid, err)
+	}
+	if _, err := dmWWID("dm-1"); err == nil {
+		t.Fatalf("dmWWID(dm-1) should fail for a non multipath map")
+	}
+	if _, err := dmWWID("dm-2"); err == nil {
+		t.Fatalf("dmWWID(dm-2) should fail for a missing device")
+	}
+}
+
+func TestStoreIsManagedHostName(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Attachments keep the host name portal of logins
+	util := &ISCSIUtil{Opts: ISCSIOptions{Resolver: fakeResolver{"array-a.local": {"192.168.206.50", "192.168.206.60"}}}}
+	targets := util.resolveTargets(context.Background(), nil, []*Target{{Portal: "array-a.local", Name: "iqn.2004-08.com.qsan:dev3.ctr1"}})
+	if err := store.Save(&Attachment{ID: "pvc-1", Targets: targets}); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := store.Load("pvc-1"); a.Targets[0].Portal != "array-a.local" {
+		t.Fatalf("stored portal got %s, expect the host name", a.Targets[0].Portal)
+	}
+
+	isManaged, err := store.IsManaged(context.Background(), util)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, portal := range []string{"192.168.206.50:3260", "192.168.206.60:3260"} {
+		if !isManaged(&Session{Portal: portal, Target: "iqn.2004-08.com.qsan:dev3.ctr1"}) {
+			t.Errorf("session on %s should be managed", portal)
+		}
+	}
+	if isManaged(&Session{Portal: "192.168.206.51:3260", Target: "iqn.2004-08.com.qsan:dev3.ctr1"}) {
+		t.Errorf("session on another address should not be managed")
+	}
+}
@@ -0,0 +1,254 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Topology node types. Block device nodes have the lsblk TYPE, such as
+// "disk", "mpath", "part", "lvm" or "crypt".
+const (
+	TopologyTarget  = "target"
+	TopologySession = "session"
+	TopologyHost    = "host"
+	TopologyMount   = "mount"
+)
+
+// TopologyNode is a target, session, SCSI host, block device or mount point.
+// IDs are "target:<iqn>", "session:<sid>", "host:<number>", "dev:<kname>"
+// and "mount:<path>".
+type TopologyNode struct {
+	ID    string            `json:"id" yaml:"id"`
+	Type  string            `json:"type" yaml:"type"`
+	Label string            `json:"label" yaml:"label"`
+	Attrs map[string]string `json:"attrs,omitempty" yaml:"attrs,omitempty"`
+}
+
+// TopologyEdge links a node to a node built on it, e.g. a session to its SCSI
+// host or a SCSI disk to its multipath map.
+type TopologyEdge struct {
+	From string `json:"from" yaml:"from"`
+	To   string `json:"to" yaml:"to"`
+}
+
+// Topology is the storage graph of the iSCSI sessions of the host, from
+// targets through sessions, SCSI hosts, SCSI disks, dm maps, partitions and
+// LVM volumes to mount points.
+type Topology struct {
+	Nodes []*TopologyNode `json:"nodes" yaml:"nodes"`
+	Edges []*TopologyEdge `json:"edges" yaml:"edges"`
+
+	index map[string]*TopologyNode
+	edges map[TopologyEdge]bool
+}
+
+// blockDevice is a line of `lsblk -rn -o NAME,KNAME,PKNAME,TYPE,MOUNTPOINT`.
+// Devices with several parents, such as multipath maps, have one line per
+// parent.
+type blockDevice struct {
+	name, kname, pkname, typ, mountpoint string
+}
+
+// Topology returns the storage graph of the current sessions.
+func (iscsi *ISCSIUtil) Topology(ctx context.Context) (_ *Topology, err error) {
+	ctx, span := iscsi.startSpan(ctx, "Topology")
+	defer endSpan(span, &err)
+
+	sessions := iscsi.sessions(ctx, true)
+	out, err := iscsi.execCmd(ctx, "lsblk", "-rn", "-o", "NAME,KNAME,PKNAME,TYPE,MOUNTPOINT")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list block devices, err: %v", err)
+	}
+
+	topo := buildTopology(sessions, parseBlockDevices(out))
+	iscsi.logger().V(2).Info("Topology", "nodeCnt", len(topo.Nodes), "edgeCnt", len(topo.Edges))
+	return topo, nil
+}
+
+// buildTopology links sessions to the block devices built on their SCSI disks.
+func buildTopology(sessions []*Session, devices []*blockDevice) *Topology {
+	topo := &Topology{index: make(map[string]*TopologyNode), edges: make(map[TopologyEdge]bool)}
+
+	children := make(map[string][]*blockDevice)
+	for _, dev := range devices {
+		if dev.pkname != "" {
+			children[dev.pkname] = append(children[dev.pkname], dev)
+		}
+	}
+	var addDevice func(from string, dev *blockDevice)
+	addDevice = func(from string, dev *blockDevice) {
+		id := "dev:" + dev.kname
+		_, seen := topo.index[id]
+		node := topo.addNode(id, dev.typ, dev.kname)
+		if dev.name != dev.kname {
+			node.Label = dev.name + " (" + dev.kname + ")"
+		}
+		topo.addEdge(from, id)
+		if dev.mountpoint != "" {
+			topo.addNode("mount:"+dev.mountpoint, TopologyMount, dev.mountpoint)
+			topo.addEdge(id, "mount:"+dev.mountpoint)
+		}
+		if seen {
+			return
+		}
+		for _, child := range children[dev.kname] {
+			addDevice(id, child)
+		}
+	}
+
+	disks := make(map[string]*blockDevice)
+	for _, dev := range devices {
+		if _, ok := disks[dev.kname]; !ok {
+			disks[dev.kname] = dev
+		}
+	}
+
+	sorted := append([]*Session(nil), sessions...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].SID < sorted[j].SID })
+	for _, sess := range sorted {
+		targetID := "target:" + sess.Target
+		topo.addNode(targetID, TopologyTarget, sess.Target)
+
+		sessID := "session:" + strconv.Itoa(sess.SID)
+		node := topo.addNode(sessID, TopologySession, "session"+strconv.Itoa(sess.SID))
+		node.Attrs = map[string]string{"portal": sess.Portal, "state": sess.State}
+		if sess.Iface != "" {
+			node.Attrs["iface"] = sess.Iface
+		}
+		topo.addEdge(targetID, sessID)
+
+		hostID := "host:" + strconv.Itoa(sess.Host)
+		topo.addNode(hostID, TopologyHost, "host"+strconv.Itoa(sess.Host))
+		topo.addEdge(sessID, hostID)
+
+		for _, scsiDev := range sess.SCSIDevices {
+			if scsiDev.Name == "" {
+				continue
+			}
+			dev, ok := disks[scsiDev.Name]
+			if !ok {
+				dev = &blockDevice{name: scsiDev.Name, kname: scsiDev.Name, typ: "disk"}
+			}
+			addDevice(hostID, dev)
+			node := topo.index["dev:"+scsiDev.Name]
+			node.Attrs = map[string]string{"lun": strconv.FormatUint(scsiDev.Lun, 10), "state": scsiDev.State}
+		}
+	}
+
+	return topo
+}
+
+func (topo *Topology) addNode(id, typ, label string) *TopologyNode {
+	if node, ok := topo.index[id]; ok {
+		return node
+	}
+
+	node := &TopologyNode{ID: id, Type: typ, Label: label}
+	topo.index[id] = node
+	topo.Nodes = append(topo.Nodes, node)
+	return node
+}
+
+func (topo *Topology) addEdge(from, to string) {
+	edge := TopologyEdge{From: from, To: to}
+	if topo.edges[edge] {
+		return
+	}
+
+	topo.edges[edge] = true
+	topo.Edges = append(topo.Edges, &edge)
+}
+
+// WriteDOT writes the topology as a Graphviz digraph, e.g. for
+// `dot -Tsvg -o topology.svg`.
+func (topo *Topology) WriteDOT(w io.Writer) error {
+	shapes := map[string]string{
+		TopologyTarget:  "box",
+		TopologySession: "ellipse",
+		TopologyHost:    "hexagon",
+		TopologyMount:   "folder",
+		"disk":          "cylinder",
+	}
+
+	var sb strings.Builder
+	sb.WriteString("digraph goiscsi {\n\trankdir=LR;\n")
+	for _, node := range topo.Nodes {
+		shape, ok := shapes[node.Type]
+		if !ok {
+			shape = "component"
+		}
+
+		label := node.Label
+		keys := make([]string, 0, len(node.Attrs))
+		for key := range node.Attrs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			label += "\n" + key + ": " + node.Attrs[key]
+		}
+		fmt.Fprintf(&sb, "\t%s [label=%s, shape=%s];\n", dotQuote(node.ID), dotQuote(label), shape)
+	}
+	for _, edge := range topo.Edges {
+		fmt.Fprintf(&sb, "\t%s -> %s;\n", dotQuote(edge.From), dotQuote(edge.To))
+	}
+	sb.WriteString("}\n")
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	return `"` + strings.ReplaceAll(s, "\n", `\n`) + `"`
+}
+
+// parseBlockDevices parses the output of `lsblk -rn -o NAME,KNAME,PKNAME,TYPE,MOUNTPOINT`.
+// Raw output escapes spaces and other special characters as \xHH.
+func parseBlockDevices(out string) []*blockDevice {
+	var devices []*blockDevice
+	for _, line := range strings.Split(out, "\n") {
+		tokens := strings.Split(line, " ")
+		if len(tokens) < 4 || tokens[1] == "" {
+			continue
+		}
+		dev := &blockDevice{
+			name:   unescapeLsblk(tokens[0]),
+			kname:  tokens[1],
+			pkname: tokens[2],
+			typ:    tokens[3],
+		}
+		if len(tokens) > 4 {
+			dev.mountpoint = unescapeLsblk(tokens[4])
+		}
+		devices = append(devices, dev)
+	}
+
+	return devices
+}
+
+func unescapeLsblk(s string) string {
+	if !strings.Contains(s, `\x`) {
+		return s
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if b, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				sb.WriteByte(byte(b))
+				i += 3
+				continue
+			}
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
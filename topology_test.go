@@ -0,0 +1,80 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBuildTopology(t *testing.T) {
+	out, err := os.ReadFile("testdata/session_p3.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsblk, err := os.ReadFile("testdata/lsblk_topology.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topo := buildTopology(parseSessions(string(out)), parseBlockDevices(string(lsblk)))
+
+	edges := make(map[TopologyEdge]bool)
+	for _, edge := range topo.Edges {
+		edges[*edge] = true
+	}
+	expected := []TopologyEdge{
+		{"target:iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr1", "session:1"},
+		{"session:1", "host:3"},
+		{"host:3", "dev:sdb"},
+		{"host:3", "dev:sdc"},
+		{"session:2", "host:4"},
+		{"host:4", "dev:sdd"},
+		{"dev:sdb", "dev:dm-0"},
+		{"dev:sdd", "dev:dm-0"},
+		{"dev:dm-0", "dev:dm-2"},
+		{"dev:dm-2", "mount:/mnt/data dir"},
+		{"dev:sdc", "dev:dm-1"},
+		{"dev:dm-1", "mount:/var/lib/app"},
+		{"target:iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr1", "session:2"},
+		{"target:iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr2", "session:3"},
+		{"session:3", "host:5"},
+		{"host:5", "dev:sde"},
+	}
+	for _, edge := range expected {
+		if !edges[edge] {
+			t.Errorf("Edge %s -> %s not found", edge.From, edge.To)
+		}
+	}
+	if len(topo.Edges) != len(expected) {
+		for _, edge := range topo.Edges {
+			t.Logf("%s -> %s", edge.From, edge.To)
+		}
+		t.Errorf("Got %d edges, expect %d", len(topo.Edges), len(expected))
+	}
+
+	for _, node := range topo.Nodes {
+		if node.ID == "dev:sda" || node.ID == "mount:/" {
+			t.Errorf("Local disk %s should not be in topology", node.ID)
+		}
+	}
+	if node := topo.index["dev:dm-0"]; node == nil || node.Type != "mpath" || node.Label != "mpatha (dm-0)" {
+		t.Errorf("Unexpected dm node: %+v", node)
+	}
+	if node := topo.index["dev:sde"]; node == nil || node.Attrs["state"] != "blocked" || node.Attrs["lun"] != "0" {
+		t.Errorf("Unexpected sd node: %+v", node)
+	}
+
+	var buf bytes.Buffer
+	if err := topo.WriteDOT(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dot := buf.String()
+	for _, s := range []string{"digraph goiscsi {", `"dev:dm-0" [label="mpatha (dm-0)", shape=component];`, `"dev:sdb" -> "dev:dm-0";`, `label="session3\niface: default\nportal: [fe80::1]:3260\nstate: FAILED"`} {
+		if !strings.Contains(dot, s) {
+			t.Errorf("DOT does not contain %s:\n%s", s, dot)
+		}
+	}
+}
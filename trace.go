@@ -0,0 +1,60 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/QsanJohnson/goiscsi"
+
+// tracer returns the tracer of ISCSIOptions.TracerProvider, or of the global
+// provider if it is not set.
+func (iscsi *ISCSIUtil) tracer() trace.Tracer {
+	tp := iscsi.Opts.TracerProvider
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// startSpan starts a span as a child of the span in ctx.
+func (iscsi *ISCSIUtil) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return iscsi.tracer().Start(ctx, "goiscsi."+name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records *err, if any, on span and ends it. err may be nil.
+func endSpan(span trace.Span, err *error) {
+	if err != nil && *err != nil {
+		span.RecordError(*err)
+		span.SetStatus(codes.Error, (*err).Error())
+	}
+	span.End()
+}
+
+// targetAttrs returns the span attributes identifying target.
+func targetAttrs(target *Target) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("iscsi.target", target.Name),
+		attribute.String("iscsi.portal", target.Portal),
+		attribute.Int64("iscsi.lun", int64(target.Lun)),
+	}
+}
+
+// targetsAttrs returns the span attributes of the names and portals of targets.
+func targetsAttrs(targets []*Target) []attribute.KeyValue {
+	var names, portals []string
+	for _, target := range targets {
+		names = append(names, target.Name)
+		portals = append(portals, target.Portal)
+	}
+	return []attribute.KeyValue{
+		attribute.StringSlice("iscsi.targets", names),
+		attribute.StringSlice("iscsi.portals", portals),
+	}
+}
@@ -0,0 +1,43 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestExecSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	util := &ISCSIUtil{Opts: ISCSIOptions{TracerProvider: tp}}
+
+	ctx, parent := util.startSpan(context.Background(), "Login", targetsAttrs([]*Target{{Portal: "192.168.206.50:3260", Name: "iqn.2004-08.com.qsan:dev1.ctr1"}})...)
+	util.execCmd(ctx, "echo", "-n", "node.session.auth.password", "-v", "secret")
+	util.execCmd(ctx, "false")
+	parent.End()
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("got %d spans, expect 3", len(spans))
+	}
+	for _, span := range spans[:2] {
+		if span.Name() != "goiscsi.exec" || span.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Fatalf("span %s is not an exec child of Login", span.Name())
+		}
+	}
+	for _, attr := range spans[0].Attributes() {
+		if attr.Key == "exec.args" {
+			if args := attr.Value.AsStringSlice(); args[3] != "<redacted>" {
+				t.Fatalf("exec.args not redacted: %v", args)
+			}
+		}
+	}
+	if spans[0].Status().Code == codes.Error || spans[1].Status().Code != codes.Error {
+		t.Fatalf("exec span status got %v and %v", spans[0].Status().Code, spans[1].Status().Code)
+	}
+}
@@ -7,9 +7,13 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
-	"github.com/golang/glog"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func contains(s []string, str string) bool {
@@ -22,28 +26,154 @@ func contains(s []string, str string) bool {
 	return false
 }
 
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func firstExistingPath(paths []string) (string, bool) {
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return path, true
+		}
+	}
+
+	return "", false
+}
+
+// forEach calls fn for every index in [0, n) from at most workers goroutines
+// and waits for all calls to return. fn should check ctx before starting work.
+func forEach(ctx context.Context, n, workers int, fn func(ctx context.Context, i int)) {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > n {
+		workers = n
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(ctx, i)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// sleepContext sleeps for d, returning early with the ctx error if ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
 func writeDeviceFile(devFile, content string) error {
 	data := []byte(content)
 	return os.WriteFile(devFile, data, 0644)
 }
 
-func execCmd(name string, args ...string) (string, error) {
-	glog.V(3).Infof("[execCmd] %s, args=%+v \n", name, args)
-	cmd := exec.Command(name, args...)
-	out, err := cmd.CombinedOutput()
-	glog.V(4).Infof("[execCmd] Output ==>\n%+v\n", string(out))
+// writeFileAtomic writes data to a temporary file in the same directory and
+// renames it over path, so readers never observe a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
 	if err != nil {
-		return "", fmt.Errorf("%s (%s)\n", strings.TrimRight(string(out), "\n"), err)
+		return err
 	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
 
-	return string(out), err
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpName, path)
 }
 
-func execCmdContext(ctx context.Context, name string, args ...string) (string, error) {
-	glog.V(3).Infof("[execCmdContext] %s, args=%+v \n", name, args)
-	cmd := exec.CommandContext(ctx, name, args...)
+// lockFile opens path and takes an flock on it, shared or exclusive. The lock
+// is released by unlockFile or when the process exits.
+func lockFile(path string, exclusive bool) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open lock file, err: %v", err)
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err = syscall.Flock(int(file.Fd()), how)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Failed to lock %s, err: %v", path, err)
+	}
+
+	return file, nil
+}
+
+func unlockFile(file *os.File) {
+	syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+	file.Close()
+}
+
+// execCmd runs a command in a span of ctx. The command is not cancelled with
+// ctx, use execCmdContext for commands which may be interrupted.
+func (iscsi *ISCSIUtil) execCmd(ctx context.Context, name string, args ...string) (string, error) {
+	return iscsi.runCmd(ctx, exec.Command(name, args...))
+}
+
+func (iscsi *ISCSIUtil) execCmdContext(ctx context.Context, name string, args ...string) (string, error) {
+	return iscsi.runCmd(ctx, exec.CommandContext(ctx, name, args...))
+}
+
+func (iscsi *ISCSIUtil) runCmd(ctx context.Context, cmd *exec.Cmd) (_ string, err error) {
+	name, args := cmd.Args[0], redactArgs(cmd.Args[1:])
+	_, span := iscsi.startSpan(ctx, "exec",
+		attribute.String("exec.cmd", name), attribute.StringSlice("exec.args", args))
+	defer endSpan(span, &err)
+
+	log := iscsi.logger().WithValues("cmd", name, "args", args)
+	log.V(3).Info("Run command")
+	start := time.Now()
 	out, err := cmd.CombinedOutput()
-	glog.V(3).Infof("[execCmdContext] Output ==>\n%+v\n", string(out))
+	log.V(4).Info("Command output", "duration", time.Since(start), "output", redactOutput(string(out)))
 	if err != nil {
 		return "", fmt.Errorf("%s (%s)\n", strings.TrimRight(string(out), "\n"), err)
 	}
@@ -51,6 +181,30 @@ func execCmdContext(ctx context.Context, name string, args ...string) (string, e
 	return string(out), err
 }
 
+// redactArgs returns a copy of args with the values of secret settings, such as
+// CHAP passwords, replaced.
+func redactArgs(args []string) []string {
+	redacted := append([]string(nil), args...)
+	for i := 0; i+3 < len(redacted); i++ {
+		if redacted[i] == "-n" && strings.Contains(redacted[i+1], "password") && redacted[i+2] == "-v" {
+			redacted[i+3] = "<redacted>"
+		}
+	}
+	return redacted
+}
+
+// redactOutput returns out with the values of "key = value" lines of secret
+// settings replaced, as printed by `iscsiadm -o show -S`.
+func redactOutput(out string) string {
+	lines := strings.Split(out, "\n")
+	for i, line := range lines {
+		if key, _ := fieldKeyValue(line, "="); strings.Contains(line, "=") && strings.Contains(key, "password") {
+			lines[i] = key + " = <redacted>"
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
 func sessionFieldValue(s string) string {
 	_, value := fieldKeyValue(s, ":")
 	return value
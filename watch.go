@@ -0,0 +1,258 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type EventType string
+
+const (
+	SessionLoggedIn EventType = "SessionLoggedIn" // A session is created or recovered
+	SessionFailed   EventType = "SessionFailed"   // A session leaves LOGGED_IN or disappears
+	PathOffline     EventType = "PathOffline"     // A SCSI device leaves the running state
+	PathRecovered   EventType = "PathRecovered"   // A SCSI device is running again
+	LUNAdded        EventType = "LUNAdded"        // A SCSI device is attached to a session
+	LUNRemoved      EventType = "LUNRemoved"      // A SCSI device is detached from a session
+	CapacityChanged EventType = "CapacityChanged" // The size of a SCSI device changed
+)
+
+const (
+	sessionStateLoggedIn = "LOGGED_IN"
+	deviceStateRunning   = "running"
+	defaultWatchInterval = 5 * time.Second
+)
+
+// Event is a change of a session or SCSI device of a watched target. Session
+// is a copy of the session at the time of the event. Device, Lun and the sizes
+// are set for path, LUN and capacity events.
+type Event struct {
+	Type    EventType
+	Time    time.Time
+	Target  *Target
+	Session *Session
+	Device  string
+	Lun     uint64
+	OldSize uint64 // Bytes
+	Size    uint64 // Bytes
+}
+
+type WatchOptions struct {
+	Interval time.Duration // Interval between session snapshots, default is 5 seconds
+}
+
+// watchSnapshot holds the sessions of the watched targets keyed by SID and
+// the sizes of their SCSI devices keyed by kernel name.
+type watchSnapshot struct {
+	sessions map[int]*Session
+	sizes    map[string]uint64
+}
+
+// Watch polls session snapshots of targets and sends an event on the returned
+// channel for each change between two snapshots. Sessions of the target name,
+// portal and iface are watched whatever their LUN, so that LUNs added to the
+// target are reported. The first snapshot is the baseline, so existing
+// sessions and devices do not produce events. A round whose sessions cannot
+// be listed is skipped. The channel is closed when ctx is done.
+func (iscsi *ISCSIUtil) Watch(ctx context.Context, targets []*Target, opts *WatchOptions) (<-chan *Event, error) {
+	if err := validateTargets(targets); err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("No target to watch")
+	}
+
+	interval := defaultWatchInterval
+	if opts != nil && opts.Interval > 0 {
+		interval = opts.Interval
+	}
+
+	resolved := iscsi.resolveTargets(ctx, iscsi.sessions(ctx, false), targets)
+	prev, err := iscsi.watchSnapshot(ctx, resolved)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get session, err: %v", err)
+	}
+	events := make(chan *Event)
+	go func() {
+		defer close(events)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			cur, err := iscsi.watchSnapshot(ctx, resolved)
+			if err != nil {
+				iscsi.logger().Error(err, "Failed to get session, skip watch round")
+				continue
+			}
+			for _, event := range diffWatchSnapshots(targets, resolved, prev, cur, time.Now()) {
+				iscsi.logger().V(2).Info("Watch event", "event", event.Type, "target", event.Session.Target,
+					"portal", event.Session.Portal, "sid", event.Session.SID, "device", event.Device)
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+			prev = cur
+		}
+	}()
+
+	return events, nil
+}
+
+func (iscsi *ISCSIUtil) watchSnapshot(ctx context.Context, resolved []*Target) (*watchSnapshot, error) {
+	sessions, err := iscsi.freshSessions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := newWatchSnapshot(sessions, resolved)
+	for _, sess := range snap.sessions {
+		for _, scsiDev := range sess.SCSIDevices {
+			if scsiDev.Name != "" {
+				snap.sizes[scsiDev.Name] = deviceSize(scsiDev.Name)
+			}
+		}
+	}
+
+	return snap, nil
+}
+
+// newWatchSnapshot returns the snapshot of the sessions of the resolved targets.
+// Device sizes are left to the caller.
+func newWatchSnapshot(sessions []*Session, resolved []*Target) *watchSnapshot {
+	snap := &watchSnapshot{sessions: make(map[int]*Session), sizes: make(map[string]uint64)}
+	for _, sess := range sessions {
+		if watchedTarget(resolved, sess) >= 0 {
+			snap.sessions[sess.SID] = sess
+		}
+	}
+
+	return snap
+}
+
+// watchedTarget returns the index of the first resolved target of sess, or -1.
+func watchedTarget(resolved []*Target, sess *Session) int {
+	for i, target := range resolved {
+		if sessionOfTarget(sess, target) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// diffWatchSnapshots returns the events between the prev and cur snapshots.
+// Events refer to the caller's targets, resolved being their resolved copies.
+func diffWatchSnapshots(targets, resolved []*Target, prev, cur *watchSnapshot, now time.Time) []*Event {
+	var events []*Event
+	newEvent := func(typ EventType, sess *Session) *Event {
+		s := *sess
+		event := &Event{Type: typ, Time: now, Session: &s}
+		if i := watchedTarget(resolved, sess); i >= 0 {
+			event.Target = targets[i]
+		}
+		events = append(events, event)
+		return event
+	}
+
+	for _, sid := range sortedSIDs(prev.sessions) {
+		if _, ok := cur.sessions[sid]; !ok {
+			newEvent(SessionFailed, prev.sessions[sid])
+		}
+	}
+
+	for _, sid := range sortedSIDs(cur.sessions) {
+		sess := cur.sessions[sid]
+		old, ok := prev.sessions[sid]
+		switch {
+		case !ok && sess.State == sessionStateLoggedIn:
+			newEvent(SessionLoggedIn, sess)
+		case !ok:
+			newEvent(SessionFailed, sess)
+		case old.State != sessionStateLoggedIn && sess.State == sessionStateLoggedIn:
+			newEvent(SessionLoggedIn, sess)
+		case old.State == sessionStateLoggedIn && sess.State != sessionStateLoggedIn:
+			newEvent(SessionFailed, sess)
+		}
+		if !ok {
+			// Devices of a new session are new LUN paths
+			old = &Session{}
+		}
+
+		oldDevs := make(map[uint64]*SCSIDevice)
+		for _, scsiDev := range old.SCSIDevices {
+			oldDevs[scsiDev.Lun] = scsiDev
+		}
+		for _, scsiDev := range sess.SCSIDevices {
+			oldDev, found := oldDevs[scsiDev.Lun]
+			delete(oldDevs, scsiDev.Lun)
+			switch {
+			case !found:
+				e := newEvent(LUNAdded, sess)
+				e.Device, e.Lun, e.Size = scsiDev.Name, scsiDev.Lun, cur.sizes[scsiDev.Name]
+				continue
+			case oldDev.State == deviceStateRunning && scsiDev.State != deviceStateRunning:
+				e := newEvent(PathOffline, sess)
+				e.Device, e.Lun = scsiDev.Name, scsiDev.Lun
+			case oldDev.State != deviceStateRunning && scsiDev.State == deviceStateRunning:
+				e := newEvent(PathRecovered, sess)
+				e.Device, e.Lun = scsiDev.Name, scsiDev.Lun
+			}
+
+			oldSize, size := prev.sizes[oldDev.Name], cur.sizes[scsiDev.Name]
+			if oldDev.Name == scsiDev.Name && oldSize > 0 && size > 0 && oldSize != size {
+				e := newEvent(CapacityChanged, sess)
+				e.Device, e.Lun, e.OldSize, e.Size = scsiDev.Name, scsiDev.Lun, oldSize, size
+			}
+		}
+		if !ok {
+			continue
+		}
+		for _, scsiDev := range old.SCSIDevices {
+			if _, removed := oldDevs[scsiDev.Lun]; removed {
+				e := newEvent(LUNRemoved, sess)
+				e.Device, e.Lun = scsiDev.Name, scsiDev.Lun
+			}
+		}
+	}
+
+	return events
+}
+
+func sortedSIDs(sessions map[int]*Session) []int {
+	sids := make([]int, 0, len(sessions))
+	for sid := range sessions {
+		sids = append(sids, sid)
+	}
+	sort.Ints(sids)
+	return sids
+}
+
+// deviceSize returns the size in bytes of a block device, or 0 if unknown.
+func deviceSize(name string) uint64 {
+	data, err := os.ReadFile(filepath.Join(sysBlockDir, name, "size"))
+	if err != nil {
+		return 0
+	}
+
+	sectors, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return sectors * 512
+}
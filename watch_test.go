@@ -0,0 +1,106 @@
+// @2022 QSAN Inc. All right reserved
+
+package goiscsi
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiffWatchSnapshots(t *testing.T) {
+	out, err := os.ReadFile("testdata/session_p3.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets := []*Target{
+		{Portal: "192.168.206.50", Name: "iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr1"},
+		{Portal: "[fe80::1]", Name: "iqn.2004-08.com.qsan:xf2026-000d42f58:dev3.ctr2"},
+	}
+	util := &ISCSIUtil{}
+	resolved := util.resolveTargets(context.Background(), nil, targets)
+
+	prev := newWatchSnapshot(parseSessions(string(out)), resolved)
+	prev.sizes["sdb"] = 1 << 30
+	if len(prev.sessions) != 3 {
+		t.Fatalf("snapshot got %d sessions, expect 3", len(prev.sessions))
+	}
+
+	// SID 1 loses LUN 1, sdb goes offline and grows, SID 2 disappears,
+	// SID 3 recovers with sde running and a new SID 4 is logged in.
+	sessions := parseSessions(string(out))
+	cur := newWatchSnapshot(sessions, resolved)
+	cur.sessions[1].SCSIDevices = cur.sessions[1].SCSIDevices[:1]
+	cur.sessions[1].SCSIDevices[0].State = "offline"
+	cur.sizes["sdb"] = 2 << 30
+	delete(cur.sessions, 2)
+	cur.sessions[3].State = "LOGGED_IN"
+	cur.sessions[3].SCSIDevices[0].State = "running"
+	cur.sessions[4] = &Session{SID: 4, Target: targets[1].Name, Portal: "[fe80::1]:3260", State: "LOGGED_IN",
+		SCSIDevices: []*SCSIDevice{{Lun: 0, Name: "sdf", State: "running"}}}
+
+	events := diffWatchSnapshots(targets, resolved, prev, cur, time.Now())
+	expected := []struct {
+		typ    EventType
+		sid    int
+		device string
+	}{
+		{SessionFailed, 2, ""},
+		{PathOffline, 1, "sdb"},
+		{CapacityChanged, 1, "sdb"},
+		{LUNRemoved, 1, "sdc"},
+		{SessionLoggedIn, 3, ""},
+		{PathRecovered, 3, "sde"},
+		{SessionLoggedIn, 4, ""},
+		{LUNAdded, 4, "sdf"},
+	}
+	if len(events) != len(expected) {
+		for _, e := range events {
+			t.Logf("%s sid=%d device=%s", e.Type, e.Session.SID, e.Device)
+		}
+		t.Fatalf("got %d events, expect %d", len(events), len(expected))
+	}
+	for i, e := range expected {
+		got := events[i]
+		if got.Type != e.typ || got.Session.SID != e.sid || got.Device != e.device {
+			t.Errorf("event %d got %s sid=%d device=%s, expect %s sid=%d device=%s",
+				i, got.Type, got.Session.SID, got.Device, e.typ, e.sid, e.device)
+		}
+	}
+	if events[2].OldSize != 1<<30 || events[2].Size != 2<<30 {
+		t.Errorf("CapacityChanged got %d => %d", events[2].OldSize, events[2].Size)
+	}
+	if events[6].Target != targets[1] {
+		t.Errorf("SessionLoggedIn of SID 4 got target %+v", events[6].Target)
+	}
+
+	if events := diffWatchSnapshots(targets, resolved, cur, cur, time.Now()); len(events) != 0 {
+		t.Errorf("same snapshots got %d events", len(events))
+	}
+}
+
+func TestWatchFailedSnapshot(t *testing.T) {
+	targets := []*Target{{Portal: "192.168.206.50", Name: "iqn.2004-08.com.qsan:dev3.ctr1"}}
+	fakeIscsiadm(t, "iscsiadm: initiator reported error", 1)
+	if _, err := (&ISCSIUtil{}).Watch(context.Background(), targets, nil); err == nil {
+		t.Fatalf("expect error when the baseline snapshot fails")
+	}
+}
+
+func TestDeviceSize(t *testing.T) {
+	dir := t.TempDir()
+	defer func(old string) { sysBlockDir = old }(sysBlockDir)
+	sysBlockDir = dir
+
+	os.MkdirAll(filepath.Join(dir, "sdb"), 0755)
+	os.WriteFile(filepath.Join(dir, "sdb", "size"), []byte("2097152\n"), 0644)
+	if size := deviceSize("sdb"); size != 1<<30 {
+		t.Fatalf("unexpected size of sdb: %d", size)
+	}
+	if size := deviceSize("sdc"); size != 0 {
+		t.Fatalf("unknown device should have size 0, got %d", size)
+	}
+}